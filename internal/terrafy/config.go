@@ -9,27 +9,54 @@ import (
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
 	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/zclconf/go-cty/cty"
 )
 
 type resourceAddr struct {
+	// Module is the address of the module instance that the resource
+	// belongs to, as returned by moduleInstanceString, or an empty string
+	// for the root module. Where a resourceAddr represents a resource in the
+	// configuration, rather than in the state, this is the module path
+	// without any instance keys, as returned by ConfigAddr.
+	Module string
+
 	Mode tfjson.ResourceMode
 	Type string
 	Name string
 }
 
 func (addr resourceAddr) String() string {
+	var prefix string
+	if addr.Module != "" {
+		prefix = addr.Module + "."
+	}
 	switch addr.Mode {
 	case tfjson.ManagedResourceMode:
-		return fmt.Sprintf("%s.%s", addr.Type, addr.Name)
+		return fmt.Sprintf("%s%s.%s", prefix, addr.Type, addr.Name)
 	case tfjson.DataResourceMode:
-		return fmt.Sprintf("data.%s.%s", addr.Type, addr.Name)
+		return fmt.Sprintf("%sdata.%s.%s", prefix, addr.Type, addr.Name)
 	default:
 		panic("invalid resource address mode")
 	}
 }
 
+// ConfigAddr returns the address of the resource configuration block that
+// the given resource belongs to, which is the same address but without
+// any module instance keys.
+func (addr resourceAddr) ConfigAddr() resourceAddr {
+	steps, ok := moduleStepsFromString(addr.Module)
+	if !ok {
+		// Should never happen, because we always construct Module from
+		// moduleInstanceString.
+		panic(fmt.Sprintf("invalid module address %q", addr.Module))
+	}
+	addr.Module = modulePathString(steps)
+	return addr
+}
+
 func (addr resourceAddr) InstanceIDs(ids cty.Value) map[resourceInstanceAddr]string {
 	switch {
 	case ids.Type() == cty.String:
@@ -83,6 +110,74 @@ func (addr resourceInstanceAddr) String() string {
 	}
 }
 
+// Traversal returns a traversal that would refer to the resource instance
+// in the Terraform language, such as in the "to" argument of an import block.
+func (addr resourceInstanceAddr) Traversal() hcl.Traversal {
+	var traversal hcl.Traversal
+	steps, _ := moduleStepsFromString(addr.Resource.Module)
+	for _, step := range steps {
+		traversal = append(traversal, hcl.TraverseAttr{Name: "module"})
+		traversal = append(traversal, hcl.TraverseAttr{Name: step.Name})
+		switch k := step.InstanceKey.(type) {
+		case string:
+			traversal = append(traversal, hcl.TraverseIndex{Key: cty.StringVal(k)})
+		case int:
+			traversal = append(traversal, hcl.TraverseIndex{Key: cty.NumberIntVal(int64(k))})
+		}
+	}
+	if addr.Resource.Mode == tfjson.DataResourceMode {
+		traversal = append(traversal, hcl.TraverseAttr{Name: "data"})
+	}
+	traversal = append(traversal, hcl.TraverseAttr{Name: addr.Resource.Type})
+	traversal = append(traversal, hcl.TraverseAttr{Name: addr.Resource.Name})
+	switch k := addr.InstanceKey.(type) {
+	case string:
+		traversal = append(traversal, hcl.TraverseIndex{Key: cty.StringVal(k)})
+	case int:
+		traversal = append(traversal, hcl.TraverseIndex{Key: cty.NumberIntVal(int64(k))})
+	}
+
+	// The first step must be a root, rather than an attribute.
+	traversal[0] = hcl.TraverseRoot{Name: traversal[0].(hcl.TraverseAttr).Name}
+	return traversal
+}
+
+// resourceInstanceAddrFromTraversal is the opposite of
+// resourceInstanceAddr.Traversal, returning false if the given traversal
+// isn't a valid managed resource instance address.
+func resourceInstanceAddrFromTraversal(traversal hcl.Traversal) (resourceInstanceAddr, bool) {
+	var ret resourceInstanceAddr
+	steps, traversal, ok := moduleStepsFromTraversal(traversal)
+	if !ok || len(traversal) < 2 || len(traversal) > 3 {
+		return ret, false
+	}
+	typeName, ok := traversalStepName(traversal[0])
+	if !ok || typeName == "data" {
+		return ret, false
+	}
+	nameStep, ok := traversal[1].(hcl.TraverseAttr)
+	if !ok {
+		return ret, false
+	}
+	ret.Resource = resourceAddr{
+		Module: moduleInstanceString(steps),
+		Mode:   tfjson.ManagedResourceMode,
+		Type:   typeName,
+		Name:   nameStep.Name,
+	}
+	if len(traversal) == 3 {
+		keyStep, ok := traversal[2].(hcl.TraverseIndex)
+		if !ok {
+			return ret, false
+		}
+		ret.InstanceKey, ok = instanceKeyFromValue(keyStep.Key)
+		if !ok {
+			return ret, false
+		}
+	}
+	return ret, true
+}
+
 type resourceAttr struct {
 	Instance resourceInstanceAddr
 	Name     string
@@ -95,13 +190,113 @@ type Config struct {
 	ManagedResources map[resourceAddr]*hcl.Block
 	ImportConfigs    map[resourceAddr]*ImportConfig
 
+	// ImportBlocks records the targets of any Terraform-native import blocks
+	// in the .tf files, which represent imports that are pending but not yet
+	// reflected in the state.
+	ImportBlocks map[string]hcl.Range
+
+	// Variables and Locals are the input variables and local values declared
+	// in the .tfy files, which the data blocks and import ids may refer to.
+	Variables map[string]*hcl.Block
+	Locals    map[string]*hcl.Attribute
+
+	// ModuleDirs are the source directories of the child modules that
+	// Terrafy could find, keyed by module path as returned by
+	// modulePathString. ManagedResources includes the resources declared in
+	// these modules as well as those in the root module.
+	ModuleDirs map[string]string
+
+	// RemoteModules records which of the modules in ModuleDirs came from
+	// a remote source, such as a module registry, rather than from a local
+	// directory, as a map from module path to the remote source address.
+	// Terraform may replace the installed copies of these at any time, so
+	// we can't generate configuration in them.
+	RemoteModules map[string]string
+
+	// Settings are the settings from the optional "terrafy" block in the
+	// .tfy files, or the defaults if there isn't one.
+	Settings Settings
+
 	SourceFiles map[string]*hcl.File
 }
 
+// Settings customize how Terrafy generates configuration.
+type Settings struct {
+	// ElideZeroValues causes Terrafy to omit optional arguments whose values
+	// are the zero value of their type, such as an empty string, and any
+	// optional nested blocks that end up empty as a result.
+	ElideZeroValues bool
+
+	// KeepZeroValues are exceptions to ElideZeroValues, as a map from
+	// resource type name to the paths of the arguments whose zero values
+	// are meaningful. A path is an argument name, possibly prefixed by the
+	// names of the nested blocks it belongs to, separated by periods.
+	KeepZeroValues map[string][]string
+
+	// SkipArguments are arguments that Terrafy must never generate, in
+	// addition to its built-in list, as a map from provider type name to
+	// argument paths in the same form as for KeepZeroValues. These are
+	// for arguments that a provider reports as optional even though they
+	// can't actually be set in the configuration.
+	SkipArguments map[string][]string
+
+	// WriteSensitiveValues causes Terrafy to write the values of the input
+	// variables it declares for sensitive arguments into a variables file
+	// that git will ignore, so that the configuration is immediately usable.
+	WriteSensitiveValues bool
+
+	// ForEachStyle selects how Terrafy generates the configuration for
+	// resources that use for_each: either forEachStyleToset or
+	// forEachStyleLocals.
+	ForEachStyle string
+
+	// DefaultFile, if not empty, is the name of the file where Terrafy
+	// generates the configuration for imports that don't set their own
+	// file, instead of deriving it from the name of the .tfy file.
+	DefaultFile string
+
+	// DefRange is the location of the "terrafy" block, if any.
+	DefRange hcl.Range
+}
+
 type ImportConfig struct {
 	Addr resourceAddr
 	ID   hcl.Expression
 
+	// ForEach, if not nil, is the collection that the ID expression is
+	// evaluated once for each element of, with each.key and each.value
+	// referring to the current element. Related imports declared in the
+	// same import block share the ForEach expression of their parent.
+	ForEach hcl.Expression
+
+	// Provider, if not empty, is the address of a non-default provider
+	// configuration that the resource belongs to, such as "aws.west".
+	// Related imports inherit the provider of their parent unless they
+	// declare their own.
+	Provider string
+
+	// Template is the source code from the body of the import block's
+	// generate block, if any, which Terrafy copies verbatim into the
+	// generated resource block.
+	Template string
+
+	// File, if not empty, is the name of the file in the module directory
+	// where Terrafy generates the configuration for the resource. Related
+	// imports inherit the file of their parent unless they set their own.
+	File string
+
+	// IgnoreAttributes and OnlyAttributes are the paths of the arguments
+	// and nested blocks that Terrafy must not generate, or the only
+	// optional ones it may generate, respectively. At most one of them is
+	// set.
+	IgnoreAttributes []string
+	OnlyAttributes   []string
+
+	// Overrides are the source code of the expressions from the import
+	// block's override block, keyed by argument path, which Terrafy
+	// generates instead of the imported values.
+	Overrides map[string]string
+
 	DefRange hcl.Range
 }
 
@@ -113,6 +308,14 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 		DataResources:    map[resourceAddr]*hcl.Block{},
 		ManagedResources: map[resourceAddr]*hcl.Block{},
 		ImportConfigs:    map[resourceAddr]*ImportConfig{},
+		ImportBlocks:     map[string]hcl.Range{},
+		Variables:        map[string]*hcl.Block{},
+		Locals:           map[string]*hcl.Attribute{},
+		ModuleDirs:       map[string]string{},
+		RemoteModules:    map[string]string{},
+		Settings: Settings{
+			ForEachStyle: forEachStyleToset,
+		},
 	}
 
 	tfFiles, tfyFiles, err := findConfigFiles(dir)
@@ -126,6 +329,8 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 	}
 
 	parser := hclparse.NewParser()
+	moduleCalls := map[string]string{}
+	moduleCallRanges := map[string]hcl.Range{}
 
 	// The .tfy files are considered to be an extension of some things declared
 	// in .tf files, and so we'll deal with the .tf files first here. We
@@ -221,18 +426,85 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 				}
 				ret.ManagedResources[addr] = block
 
+			case "import":
+				// These are Terraform's own import blocks, which we might have
+				// generated ourselves on a previous run. We track them so that
+				// we won't try to import the same objects again.
+				blockContent, _, moreDiags := block.Body.PartialContent(tfImportBlockSchema)
+				diags = append(diags, moreDiags...)
+				attr, exists := blockContent.Attributes["to"]
+				if !exists {
+					continue
+				}
+				traversal, moreDiags := hcl.AbsTraversalForExpr(attr.Expr)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+				addr, ok := resourceInstanceAddrFromTraversal(traversal)
+				if !ok {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid import target",
+						Detail:   "The import target must be a managed resource instance address.",
+						Subject:  attr.Expr.Range().Ptr(),
+					})
+					continue
+				}
+				ret.ImportBlocks[addr.String()] = block.DefRange
+
+			case "module":
+				// We track module calls so that we can find resources that
+				// are already declared in child modules, and so that we know
+				// where to generate configuration for them.
+				name := block.Labels[0]
+				if existing, exists := moduleCallRanges[name]; exists {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Duplicate module call",
+						Detail:   fmt.Sprintf("A module call named %q was already defined at %s.", name, existing),
+						Subject:  block.DefRange.Ptr(),
+					})
+					continue
+				}
+				moduleCallRanges[name] = block.DefRange
+				source, moreDiags := decodeModuleSource(block)
+				diags = append(diags, moreDiags...)
+				if source != "" {
+					moduleCalls[name] = source
+				}
+
 			default:
 				panic("HCL produced a block type that wasn't in the schema")
 			}
 		}
 	}
 
+	moreDiags := loadChildModules(parser, ret, readModuleManifest(dir), dir, nil, "", moduleCalls)
+	diags = append(diags, moreDiags...)
+
 	// We are stricter about what's allowed in .tfy files because we want to
 	// give better feedback if a user tries to use Terraform language features
 	// rather than only features of the (much smaller) Terrafy language.
+	var foundSettings bool
 	for _, fn := range tfyFiles {
-		file, moreDiags := parser.ParseHCLFile(fn)
-		diags = append(diags, moreDiags...)
+		var file *hcl.File
+		if strings.HasSuffix(fn, ".json") {
+			jsonFile, moreDiags := parser.ParseJSONFile(fn)
+			diags = append(diags, moreDiags...)
+			file = jsonFile
+			if file != nil {
+				moreDiags := checkJSONImportFeatures(fn, file)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+			}
+		} else {
+			nativeFile, moreDiags := parser.ParseHCLFile(fn)
+			diags = append(diags, moreDiags...)
+			file = nativeFile
+		}
 		if file == nil {
 			continue
 		}
@@ -268,12 +540,10 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 				diags = append(diags, moreDiags...)
 				var alias string
 				if attr, exists := blockContent.Attributes["alias"]; exists {
-					if strings.HasSuffix(attr.NameRange.Filename, ".tfy") {
-						moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &alias)
-						diags = append(diags, moreDiags...)
-						if moreDiags.HasErrors() {
-							continue
-						}
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &alias)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
 					}
 				}
 				key := block.Labels[0]
@@ -291,6 +561,87 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 				}
 				ret.ProviderConfigs[key] = block
 
+			case "terrafy":
+				if foundSettings {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Duplicate terrafy block",
+						Detail:   fmt.Sprintf("The Terrafy settings were already declared at %s.", ret.Settings.DefRange),
+						Subject:  block.DefRange.Ptr(),
+					})
+					continue
+				}
+				foundSettings = true
+				ret.Settings.DefRange = block.DefRange
+				blockContent, moreDiags := block.Body.Content(settingsBlockSchema)
+				diags = append(diags, moreDiags...)
+				if attr, exists := blockContent.Attributes["elide_zero_values"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.ElideZeroValues)
+					diags = append(diags, moreDiags...)
+				}
+				if attr, exists := blockContent.Attributes["keep_zero_values"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.KeepZeroValues)
+					diags = append(diags, moreDiags...)
+				}
+				if attr, exists := blockContent.Attributes["skip_arguments"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.SkipArguments)
+					diags = append(diags, moreDiags...)
+				}
+				if attr, exists := blockContent.Attributes["write_sensitive_values"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.WriteSensitiveValues)
+					diags = append(diags, moreDiags...)
+				}
+				if attr, exists := blockContent.Attributes["for_each_style"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.ForEachStyle)
+					diags = append(diags, moreDiags...)
+					if !moreDiags.HasErrors() && ret.Settings.ForEachStyle != forEachStyleToset && ret.Settings.ForEachStyle != forEachStyleLocals {
+						diags = diags.Append(&hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Invalid for_each style",
+							Detail:   fmt.Sprintf("The for_each style must be either %q or %q.", forEachStyleToset, forEachStyleLocals),
+							Subject:  attr.Expr.Range().Ptr(),
+						})
+					}
+				}
+				if attr, exists := blockContent.Attributes["default_file"]; exists {
+					moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &ret.Settings.DefaultFile)
+					diags = append(diags, moreDiags...)
+					if !moreDiags.HasErrors() {
+						diags = append(diags, checkTargetFile(ret.Settings.DefaultFile, attr.Expr.Range())...)
+					}
+				}
+
+			case "variable":
+				name := block.Labels[0]
+				if existing, exists := ret.Variables[name]; exists {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Duplicate variable declaration",
+						Detail:   fmt.Sprintf("An input variable %q was already declared at %s.", name, existing.DefRange),
+						Subject:  block.DefRange.Ptr(),
+					})
+					continue
+				}
+				_, moreDiags := block.Body.Content(variableBlockSchema)
+				diags = append(diags, moreDiags...)
+				ret.Variables[name] = block
+
+			case "locals":
+				attrs, moreDiags := block.Body.JustAttributes()
+				diags = append(diags, moreDiags...)
+				for name, attr := range attrs {
+					if existing, exists := ret.Locals[name]; exists {
+						diags = diags.Append(&hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Duplicate local value definition",
+							Detail:   fmt.Sprintf("A local value named %q was already defined at %s.", name, existing.NameRange),
+							Subject:  attr.NameRange.Ptr(),
+						})
+						continue
+					}
+					ret.Locals[name] = attr
+				}
+
 			case "data":
 				addr := resourceAddr{
 					Mode: tfjson.DataResourceMode,
@@ -310,10 +661,36 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 				ret.DataResources[addr] = block
 
 			case "import":
+				blockContent, moreDiags := block.Body.Content(importBlockSchema)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+				var module string
+				if attr, exists := blockContent.Attributes["module"]; exists {
+					traversal, moreDiags := hcl.AbsTraversalForExpr(attr.Expr)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					steps, rest, ok := moduleStepsFromTraversal(traversal)
+					if !ok || len(rest) != 0 || len(steps) == 0 {
+						diags = diags.Append(&hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Invalid module address",
+							Detail:   "The module argument must be the address of a module instance, such as module.network or module.network[\"a\"].",
+							Subject:  attr.Expr.Range().Ptr(),
+						})
+						continue
+					}
+					module = moduleInstanceString(steps)
+				}
+
 				addr := resourceAddr{
-					Mode: tfjson.ManagedResourceMode,
-					Type: block.Labels[0],
-					Name: block.Labels[1],
+					Module: module,
+					Mode:   tfjson.ManagedResourceMode,
+					Type:   block.Labels[0],
+					Name:   block.Labels[1],
 				}
 				// TODO: Check that the labels are both valid identifiers.
 				if existing, exists := ret.ImportConfigs[addr]; exists {
@@ -326,13 +703,111 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 					continue
 				}
 
-				blockContent, moreDiags := block.Body.Content(importBlockSchema)
+				var forEach hcl.Expression
+				if attr, exists := blockContent.Attributes["for_each"]; exists {
+					forEach = attr.Expr
+				}
+				provider, moreDiags := decodeImportProvider(blockContent)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+				template, moreDiags := decodeImportTemplate(blockContent, file.Bytes)
 				diags = append(diags, moreDiags...)
-				ret.ImportConfigs[addr] = &ImportConfig{
+				if moreDiags.HasErrors() {
+					continue
+				}
+				targetFile, moreDiags := decodeImportFile(blockContent)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+				imp := &ImportConfig{
 					Addr:     addr,
 					ID:       blockContent.Attributes["id"].Expr,
+					ForEach:  forEach,
+					Provider: provider,
+					Template: template,
+					File:     targetFile,
 					DefRange: block.DefRange,
 				}
+				moreDiags = decodeImportRules(blockContent, file.Bytes, imp)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					continue
+				}
+				ret.ImportConfigs[addr] = imp
+
+				for _, block := range blockContent.Blocks {
+					if block.Type != "related" {
+						continue
+					}
+					relAddr := resourceAddr{
+						Module: module,
+						Mode:   tfjson.ManagedResourceMode,
+						Type:   block.Labels[0],
+						Name:   block.Labels[1],
+					}
+					if forEach == nil {
+						diags = diags.Append(&hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Related import without for_each",
+							Detail:   fmt.Sprintf("A related import can only be declared in an import block that uses for_each. To import %s separately, declare it in its own import block instead.", relAddr),
+							Subject:  block.DefRange.Ptr(),
+						})
+						continue
+					}
+					if existing, exists := ret.ImportConfigs[relAddr]; exists {
+						diags = diags.Append(&hcl.Diagnostic{
+							Severity: hcl.DiagError,
+							Summary:  "Duplicate import configuration",
+							Detail:   fmt.Sprintf("An import configuration for %s was already defined at %s.", relAddr, existing.DefRange),
+							Subject:  block.DefRange.Ptr(),
+						})
+						continue
+					}
+					relContent, moreDiags := block.Body.Content(relatedImportBlockSchema)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					relProvider, moreDiags := decodeImportProvider(relContent)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					if relProvider == "" {
+						relProvider = provider
+					}
+					relTemplate, moreDiags := decodeImportTemplate(relContent, file.Bytes)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					relFile, moreDiags := decodeImportFile(relContent)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					if relFile == "" {
+						relFile = targetFile
+					}
+					relImp := &ImportConfig{
+						Addr:     relAddr,
+						ID:       relContent.Attributes["id"].Expr,
+						ForEach:  forEach,
+						Provider: relProvider,
+						Template: relTemplate,
+						File:     relFile,
+						DefRange: block.DefRange,
+					}
+					moreDiags = decodeImportRules(relContent, file.Bytes, relImp)
+					diags = append(diags, moreDiags...)
+					if moreDiags.HasErrors() {
+						continue
+					}
+					ret.ImportConfigs[relAddr] = relImp
+				}
 
 			default:
 				panic("HCL produced a block type that wasn't in the schema")
@@ -340,11 +815,321 @@ func LoadConfig(dir string) (*Config, hcl.Diagnostics) {
 		}
 	}
 
+	// We can only generate configuration for resources in child modules
+	// whose source code we could find.
+	for addr, imp := range ret.ImportConfigs {
+		if addr.Module == "" {
+			// Child modules usually receive their provider configurations
+			// from their callers, so we can only check that the provider
+			// configuration exists in the root module.
+			if imp.Provider != "" {
+				if _, exists := ret.ProviderConfigs[imp.Provider]; !exists {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Undeclared provider configuration",
+						Detail:   fmt.Sprintf("Cannot import %s using provider configuration %s, because there is no provider block for it in the configuration.", addr, imp.Provider),
+						Subject:  imp.DefRange.Ptr(),
+					})
+				}
+			}
+			continue
+		}
+		path := addr.ConfigAddr().Module
+		if _, exists := ret.ModuleDirs[path]; !exists {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Module not found",
+				Detail:   fmt.Sprintf("Cannot import into %s, because there is no call to %s in the configuration or because Terraform hasn't installed it yet. If the module is declared, run \"terraform init\" to install it.", addr, path),
+				Subject:  imp.DefRange.Ptr(),
+			})
+			continue
+		}
+		if source, remote := ret.RemoteModules[path]; remote {
+			if _, declared := ret.ManagedResources[addr.ConfigAddr()]; !declared {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Cannot generate configuration in a remote module",
+					Detail:   fmt.Sprintf("Cannot import into %s, because it isn't declared in its module and Terrafy can't generate configuration for it there: %s comes from the remote source %q, so Terraform would discard any changes to it the next time it installs the module.\n\nTo import into a new resource in this module, first copy the module into a local directory and change its source to refer to that directory.", addr, path, source),
+					Subject:  imp.DefRange.Ptr(),
+				})
+			}
+		}
+	}
+
 	ret.SourceFiles = parser.Files()
 
 	return ret, diags
 }
 
+// checkJSONImportFeatures returns a single error diagnostic describing all
+// of the import blocks in the given .tfy.json file that use features that
+// only work in native syntax, if there are any, in which case the caller
+// should skip the file.
+//
+// Terrafy copies the source code of the generate and override blocks into
+// the generated configuration, and combines the for_each argument with the
+// id expression into a single expression in the temporary configuration,
+// none of which it can do for JSON expressions. A related import requires
+// for_each, so we can't support that either.
+func checkJSONImportFeatures(filename string, file *hcl.File) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	content, _, _ := file.Body.PartialContent(tfySchema)
+	var uses []string
+	var subject *hcl.Range
+	use := func(rng hcl.Range, format string, args ...interface{}) {
+		uses = append(uses, fmt.Sprintf(format, args...))
+		if subject == nil {
+			subject = rng.Ptr()
+		}
+	}
+	for _, block := range content.Blocks {
+		if block.Type != "import" {
+			continue
+		}
+		addr := strings.Join(block.Labels, ".")
+		blockContent, _, _ := block.Body.PartialContent(importBlockSchema)
+		if attr, exists := blockContent.Attributes["for_each"]; exists {
+			use(attr.NameRange, "the for_each argument in the import block for %s", addr)
+		}
+		for _, inner := range blockContent.Blocks {
+			switch inner.Type {
+			case "related":
+				use(inner.DefRange, "a related block for %s in the import block for %s", strings.Join(inner.Labels, "."), addr)
+				relContent, _, _ := inner.Body.PartialContent(relatedImportBlockSchema)
+				for _, relInner := range relContent.Blocks {
+					use(relInner.DefRange, "the %s block in the related block for %s", relInner.Type, strings.Join(inner.Labels, "."))
+				}
+			default:
+				use(inner.DefRange, "the %s block in the import block for %s", inner.Type, addr)
+			}
+		}
+	}
+	if len(uses) == 0 {
+		return diags
+	}
+
+	diags = diags.Append(&hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Unsupported features in JSON syntax",
+		Detail:   fmt.Sprintf("The for_each argument and the related, generate, and override blocks of import blocks are supported only in native syntax .tfy files, but %s uses:\n  - %s\n\nMove these import blocks into a .tfy file instead.", filename, strings.Join(uses, "\n  - ")),
+		Subject:  subject,
+	})
+	return diags
+}
+
+// decodeImportProvider returns the provider configuration address from the
+// provider argument in the given import block content, if any.
+func decodeImportProvider(content *hcl.BodyContent) (string, hcl.Diagnostics) {
+	attr, exists := content.Attributes["provider"]
+	if !exists {
+		return "", nil
+	}
+	traversal, diags := hcl.AbsTraversalForExpr(attr.Expr)
+	if diags.HasErrors() {
+		return "", diags
+	}
+	var alias string
+	switch len(traversal) {
+	case 1:
+	case 2:
+		if step, ok := traversal[1].(hcl.TraverseAttr); ok {
+			alias = step.Name
+			break
+		}
+		fallthrough
+	default:
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid provider configuration address",
+			Detail:   "The provider argument must be a provider configuration address, such as aws.west.",
+			Subject:  attr.Expr.Range().Ptr(),
+		})
+		return "", diags
+	}
+	ret := traversal.RootName()
+	if alias != "" {
+		ret = ret + "." + alias
+	}
+	return ret, diags
+}
+
+// decodeImportTemplate returns the source code from the body of the generate
+// block in the given import block content, if any, given the source code of
+// the whole file.
+func decodeImportTemplate(content *hcl.BodyContent, src []byte) (string, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	var found *hcl.Block
+	for _, block := range content.Blocks {
+		if block.Type != "generate" {
+			continue
+		}
+		if found != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate generate block",
+				Detail:   fmt.Sprintf("A generate block for this import was already declared at %s.", found.DefRange),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+		found = block
+	}
+	if found == nil || diags.HasErrors() {
+		return "", diags
+	}
+
+	body, native := found.Body.(*hclsyntax.Body)
+	if !native {
+		// checkJSONImportFeatures already rejected this.
+		return "", diags
+	}
+	for _, name := range templateReservedArguments {
+		if attr, exists := body.Attributes[name]; exists {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported argument",
+				Detail:   fmt.Sprintf("The %s argument can't be set in a generate block, because Terrafy decides it based on the import block.", name),
+				Subject:  attr.NameRange.Ptr(),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return "", diags
+	}
+
+	// The body's source range includes the braces around it.
+	rng := body.SrcRange
+	if rng.End.Byte-rng.Start.Byte < 2 {
+		return "", diags
+	}
+	inner := src[rng.Start.Byte+1 : rng.End.Byte-1]
+	return strings.TrimSpace(string(hclwrite.Format(inner))), diags
+}
+
+// decodeImportRules decodes the ignore_attributes and only_attributes
+// arguments and the override block from the given import block content into
+// the given import configuration, given the source code of the whole file.
+func decodeImportRules(content *hcl.BodyContent, src []byte, imp *ImportConfig) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	if attr, exists := content.Attributes["ignore_attributes"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &imp.IgnoreAttributes)...)
+	}
+	if attr, exists := content.Attributes["only_attributes"]; exists {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &imp.OnlyAttributes)...)
+		if _, conflict := content.Attributes["ignore_attributes"]; conflict {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting arguments",
+				Detail:   "An import block can set either ignore_attributes or only_attributes, but not both.",
+				Subject:  attr.NameRange.Ptr(),
+			})
+		}
+	}
+
+	fromTemplate := templateNames(imp.Template)
+	var found *hcl.Block
+	for _, block := range content.Blocks {
+		if block.Type != "override" {
+			continue
+		}
+		if found != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate override block",
+				Detail:   fmt.Sprintf("An override block for this import was already declared at %s.", found.DefRange),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+		found = block
+
+		body, native := block.Body.(*hclsyntax.Body)
+		if !native {
+			// checkJSONImportFeatures already rejected this.
+			continue
+		}
+		imp.Overrides = map[string]string{}
+		diags = append(diags, decodeOverrides(body, "", src, imp.Overrides)...)
+		for path := range imp.Overrides {
+			name := path
+			if i := strings.IndexByte(path, '.'); i >= 0 {
+				name = path[:i]
+			}
+			if fromTemplate[name] {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Conflicting override",
+					Detail:   fmt.Sprintf("The override for %s conflicts with the generate block, which already sets %s.", path, name),
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
+		}
+	}
+
+	return diags
+}
+
+// decodeOverrides adds the source code of the expressions in the given
+// override block body to the given map, keyed by the argument path with the
+// given prefix. Nested blocks in the override block select arguments in
+// nested blocks of the same type.
+func decodeOverrides(body *hclsyntax.Body, path string, src []byte, into map[string]string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for name, attr := range body.Attributes {
+		rng := attr.Expr.Range()
+		into[path+name] = string(src[rng.Start.Byte:rng.End.Byte])
+	}
+	for _, block := range body.Blocks {
+		if len(block.Labels) != 0 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported block labels",
+				Detail:   "Blocks in an override block select nested blocks by type only, so they can't have labels.",
+				Subject:  block.LabelRanges[0].Ptr(),
+			})
+			continue
+		}
+		diags = append(diags, decodeOverrides(block.Body, path+block.Type+".", src, into)...)
+	}
+	return diags
+}
+
+// decodeImportFile returns the target file name from the file argument in
+// the given import block content, if any.
+func decodeImportFile(content *hcl.BodyContent) (string, hcl.Diagnostics) {
+	attr, exists := content.Attributes["file"]
+	if !exists {
+		return "", nil
+	}
+	var ret string
+	diags := gohcl.DecodeExpression(attr.Expr, nil, &ret)
+	if diags.HasErrors() {
+		return "", diags
+	}
+	diags = append(diags, checkTargetFile(ret, attr.Expr.Range())...)
+	return ret, diags
+}
+
+// checkTargetFile returns errors if the given name isn't suitable as a file
+// for Terrafy to generate configuration into. The given range is the
+// location of the expression that the name came from.
+func checkTargetFile(name string, rng hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	validSuffix := strings.HasSuffix(name, ".tf") || strings.HasSuffix(name, ".tf.json")
+	if !validSuffix || strings.ContainsAny(name, `/\`) {
+		// Terraform only reads files directly in the module directory.
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid target file",
+			Detail:   "The target file must be the name of a .tf or .tf.json file in the module directory, such as \"network.tf\", without any directory path.",
+			Subject:  rng.Ptr(),
+		})
+	}
+	return diags
+}
+
 func findConfigFiles(dir string) (tfFiles, tfyFiles []string, err error) {
 	candidates, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -355,7 +1140,7 @@ func findConfigFiles(dir string) (tfFiles, tfyFiles []string, err error) {
 		if strings.HasSuffix(name, ".tf") || strings.HasSuffix(name, ".tf.json") {
 			tfFiles = append(tfFiles, filepath.Join(dir, name))
 		}
-		if strings.HasSuffix(name, ".tfy") {
+		if strings.HasSuffix(name, ".tfy") || strings.HasSuffix(name, ".tfy.json") {
 			tfyFiles = append(tfyFiles, filepath.Join(dir, name))
 		}
 	}
@@ -367,13 +1152,18 @@ var tfSchema = &hcl.BodySchema{
 		{Type: "terraform"},
 		{Type: "provider", LabelNames: []string{"local_name"}},
 		{Type: "resource", LabelNames: []string{"type", "name"}},
+		{Type: "module", LabelNames: []string{"name"}},
+		{Type: "import"},
 	},
 }
 
 var tfySchema = &hcl.BodySchema{
 	Blocks: []hcl.BlockHeaderSchema{
 		{Type: "terraform"},
+		{Type: "terrafy"},
 		{Type: "provider", LabelNames: []string{"local_name"}},
+		{Type: "variable", LabelNames: []string{"name"}},
+		{Type: "locals"},
 		{Type: "data", LabelNames: []string{"type", "name"}},
 		{Type: "import", LabelNames: []string{"type", "name"}},
 	},
@@ -385,14 +1175,77 @@ var terraformBlockSchema = &hcl.BodySchema{
 	},
 }
 
+var settingsBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "elide_zero_values"},
+		{Name: "keep_zero_values"},
+		{Name: "skip_arguments"},
+		{Name: "write_sensitive_values"},
+		{Name: "for_each_style"},
+		{Name: "default_file"},
+	},
+}
+
+// variableBlockSchema is the subset of Terraform's variable block arguments
+// that make sense in a Terrafy configuration. We copy the block verbatim
+// into the temporary configuration, so Terraform itself will check that
+// they are valid.
+var variableBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "type"},
+		{Name: "default"},
+		{Name: "description"},
+		{Name: "sensitive"},
+		{Name: "nullable"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "validation"},
+	},
+}
+
 var providerBlockSchema = &hcl.BodySchema{
 	Attributes: []hcl.AttributeSchema{
 		{Name: "alias"},
 	},
 }
 
+var tfImportBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "to"},
+	},
+}
+
 var importBlockSchema = &hcl.BodySchema{
 	Attributes: []hcl.AttributeSchema{
 		{Name: "id", Required: true},
+		{Name: "for_each"},
+		{Name: "module"},
+		{Name: "provider"},
+		{Name: "ignore_attributes"},
+		{Name: "only_attributes"},
+		{Name: "file"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "related", LabelNames: []string{"type", "name"}},
+		{Type: "generate"},
+		{Type: "override"},
 	},
 }
+
+var relatedImportBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "id", Required: true},
+		{Name: "provider"},
+		{Name: "ignore_attributes"},
+		{Name: "only_attributes"},
+		{Name: "file"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "generate"},
+		{Type: "override"},
+	},
+}
+
+// templateReservedArguments are the meta-arguments that Terrafy decides for
+// itself, which a generate block therefore may not set.
+var templateReservedArguments = []string{"count", "for_each", "provider"}
@@ -0,0 +1,65 @@
+package terrafy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
+
+func TestCheckJSONImportFeatures(t *testing.T) {
+	tests := map[string]struct {
+		src  string
+		want []string // empty if we expect no error
+	}{
+		"supported arguments": {
+			src: `{"import":{"test_thing":{"a":{"id":"i-1","provider":"test.west","ignore_attributes":["tags"],"file":"a.tf"}}}}`,
+		},
+		"other blocks": {
+			src: `{"data":{"test_thing":{"a":{"for_each":"x"}}},"import":{"test_thing":{"a":{"id":"${data.test_thing.a.id}"}}}}`,
+		},
+		"for_each": {
+			src: `{"import":{"test_thing":{"a":{"id":"${each.value}","for_each":"${var.ids}"}}}}`,
+			want: []string{
+				"the for_each argument in the import block for test_thing.a",
+			},
+		},
+		"everything at once": {
+			src: `{"import":{"test_thing":{
+				"a":{"id":"i-1","generate":{"name":"a"},"override":{"tags":"${var.tags}"}},
+				"b":{"id":"${each.value}","for_each":"${var.ids}","related":{"test_other":{"c":{"id":"${each.key}","generate":{}}}}}
+			}}}`,
+			want: []string{
+				"the generate block in the import block for test_thing.a",
+				"the override block in the import block for test_thing.a",
+				"the for_each argument in the import block for test_thing.b",
+				"a related block for test_other.c in the import block for test_thing.b",
+				"the generate block in the related block for test_other.c",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			file, diags := hclparse.NewParser().ParseJSON([]byte(test.src), "main.tfy.json")
+			if diags.HasErrors() {
+				t.Fatalf("invalid JSON: %s", diags.Error())
+			}
+			diags = checkJSONImportFeatures("main.tfy.json", file)
+			if len(test.want) == 0 {
+				if len(diags) != 0 {
+					t.Fatalf("unexpected diagnostics: %s", diags.Error())
+				}
+				return
+			}
+			if len(diags) != 1 {
+				t.Fatalf("wrong number of diagnostics %d; want 1", len(diags))
+			}
+			for _, want := range test.want {
+				if !strings.Contains(diags[0].Detail, "\n  - "+want+"\n") {
+					t.Errorf("missing %q in\n%s", want, diags[0].Detail)
+				}
+			}
+		})
+	}
+}
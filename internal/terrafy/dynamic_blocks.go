@@ -0,0 +1,358 @@
+package terrafy
+
+import (
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// dynamicContent describes which arguments and nested blocks the content of
+// a generated dynamic block will set, decided by considering all of the
+// blocks that it must represent together.
+type dynamicContent struct {
+	Attrs      []string
+	Overridden []string
+	Sensitive  []string
+	BlockNames []string
+	Blocks     map[string]*dynamicContent
+}
+
+// dynamicScope describes the dynamic blocks enclosing the content that
+// generateDynamicContent is generating, so that it can refer to the values
+// of sensitive arguments in input variables.
+type dynamicScope struct {
+	// Iterators are the iterator names of the enclosing dynamic blocks,
+	// outermost first.
+	Iterators []string
+
+	// Blocks are the objects representing the blocks that the content
+	// generates, for each resource instance. Each is nested in a tuple or
+	// object for each of the enclosing dynamic blocks, shaped in the same
+	// way as their for_each values, so that the keys of the iterators
+	// select a single block.
+	Blocks map[resourceInstanceAddr]cty.Value
+}
+
+// generateDynamicBlock generates a dynamic block to represent nested blocks of
+// the given type when the instances of a resource disagree about how many of
+// them there are. Each of the given values is either an object, for a block
+// type with single nesting, or a collection of objects, and might be null.
+//
+// The dynamic block's for_each expression is a lookup table of the blocks
+// for each instance, written in the same style as the lookup tables that
+// generateConfigAttribute uses for arguments that vary between instances.
+func generateDynamicBlock(addr resourceAddr, path string, typeName string, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlockType, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	var elems []cty.Value
+	for _, v := range vals {
+		elems = append(elems, nestedBlockObjects(v, schema.NestingMode)...)
+	}
+	content := planDynamicContent(path+typeName+".", elems, schema.Block, opts)
+
+	forEachVals := make(map[resourceInstanceAddr]cty.Value, len(vals))
+	for instAddr, v := range vals {
+		forEachVals[instAddr] = dynamicForEachValue(v, schema.NestingMode, content, schema.Block)
+	}
+
+	block := body.AppendNewBlock("dynamic", []string{typeName})
+	blockBody := block.Body()
+	moreDiags := generateConfigAttribute(addr, "for_each", opts.valuePrefix+typeName, forEachVals, nil, opts, blockBody)
+	diags = append(diags, moreDiags...)
+	if schema.NestingMode == tfjson.SchemaNestingModeMap {
+		setDynamicLabels(blockBody, typeName)
+	}
+	scope := &dynamicScope{
+		Iterators: []string{typeName},
+		Blocks:    make(map[resourceInstanceAddr]cty.Value, len(vals)),
+	}
+	for instAddr, v := range vals {
+		scope.Blocks[instAddr] = dynamicBlockCollection(v, schema.NestingMode)
+	}
+	contentBody := blockBody.AppendNewBlock("content", nil).Body()
+	moreDiags = generateDynamicContent(addr, path+typeName+".", typeName, content, schema.Block, scope, opts, contentBody)
+	diags = append(diags, moreDiags...)
+
+	return diags
+}
+
+// planDynamicContent decides which arguments and nested blocks the content of
+// a dynamic block must set in order to represent all of the given objects.
+func planDynamicContent(path string, objs []cty.Value, schema *tfjson.SchemaBlock, opts *genOptions) *dynamicContent {
+	ret := &dynamicContent{
+		Blocks: map[string]*dynamicContent{},
+	}
+
+	attrNames := make([]string, 0, len(schema.Attributes))
+	for name := range schema.Attributes {
+		attrNames = append(attrNames, name)
+	}
+	sort.Strings(attrNames)
+	for _, name := range attrNames {
+		attrS := schema.Attributes[name]
+		if !(attrS.Required || attrS.Optional) {
+			continue
+		}
+		if _, exists := opts.Overrides[path+name]; exists {
+			ret.Overridden = append(ret.Overridden, name)
+			continue
+		}
+		if opts.SkipArguments[path+name] || (!attrS.Required && !opts.included(path+name)) {
+			continue
+		}
+		if attrS.Optional && !attrS.Required && opts.elideZero(path+name) {
+			allZero := true
+			for _, obj := range objs {
+				if !isZeroValue(obj.GetAttr(name)) {
+					allZero = false
+					break
+				}
+			}
+			if allZero {
+				continue
+			}
+		}
+		if attrS.Sensitive {
+			ret.Sensitive = append(ret.Sensitive, name)
+			continue
+		}
+		ret.Attrs = append(ret.Attrs, name)
+	}
+
+	blockTypeNames := make([]string, 0, len(schema.NestedBlocks))
+	for typeName := range schema.NestedBlocks {
+		blockTypeNames = append(blockTypeNames, typeName)
+	}
+	sort.Strings(blockTypeNames)
+	for _, typeName := range blockTypeNames {
+		nestedS := schema.NestedBlocks[typeName]
+		if opts.SkipArguments[path+typeName] || (nestedS.MinItems == 0 && !opts.included(path+typeName)) {
+			continue
+		}
+		var nestedObjs []cty.Value
+		for _, obj := range objs {
+			nestedObjs = append(nestedObjs, nestedBlockObjects(obj.GetAttr(typeName), nestedS.NestingMode)...)
+		}
+		if len(nestedObjs) == 0 {
+			// None of the blocks we're representing have any blocks of
+			// this type, so we don't need to mention it at all.
+			continue
+		}
+		ret.BlockNames = append(ret.BlockNames, typeName)
+		ret.Blocks[typeName] = planDynamicContent(path+typeName+".", nestedObjs, nestedS.Block, opts)
+	}
+
+	return ret
+}
+
+// generateDynamicContent generates the content block of a dynamic block,
+// referring to the values of the current element through the given iterator
+// name.
+func generateDynamicContent(addr resourceAddr, path string, iterator string, content *dynamicContent, schema *tfjson.SchemaBlock, scope *dynamicScope, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	for _, name := range content.Attrs {
+		body.SetAttributeTraversal(name, hcl.Traversal{
+			hcl.TraverseRoot{Name: iterator},
+			hcl.TraverseAttr{Name: "value"},
+			hcl.TraverseAttr{Name: name},
+		})
+	}
+	for _, name := range content.Overridden {
+		// The override expression is the same for every block.
+		tokens, _ := opts.overrideTokens(path + name)
+		body.SetAttributeRaw(name, tokens)
+	}
+
+	for _, name := range content.Sensitive {
+		generateDynamicSensitiveAttribute(addr, path, name, scope, opts, body)
+	}
+
+	for _, typeName := range content.BlockNames {
+		nestedS := schema.NestedBlocks[typeName]
+		block := body.AppendNewBlock("dynamic", []string{typeName})
+		blockBody := block.Body()
+
+		collTraversal := hcl.Traversal{
+			hcl.TraverseRoot{Name: iterator},
+			hcl.TraverseAttr{Name: "value"},
+			hcl.TraverseAttr{Name: typeName},
+		}
+		if nestedS.NestingMode == tfjson.SchemaNestingModeSingle {
+			// A splat expression turns a single object into a one-element
+			// tuple, or null into an empty tuple.
+			tokens := hclwrite.TokensForTraversal(collTraversal)
+			tokens = append(tokens,
+				&hclwrite.Token{Type: hclsyntax.TokenOBrack, Bytes: []byte{'['}},
+				&hclwrite.Token{Type: hclsyntax.TokenStar, Bytes: []byte{'*'}},
+				&hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte{']'}},
+			)
+			blockBody.SetAttributeRaw("for_each", tokens)
+		} else {
+			blockBody.SetAttributeTraversal("for_each", collTraversal)
+		}
+		if nestedS.NestingMode == tfjson.SchemaNestingModeMap {
+			setDynamicLabels(blockBody, typeName)
+		}
+
+		nestedScope := &dynamicScope{
+			Iterators: append(scope.Iterators[:len(scope.Iterators):len(scope.Iterators)], typeName),
+			Blocks:    make(map[resourceInstanceAddr]cty.Value, len(scope.Blocks)),
+		}
+		for instAddr, coll := range scope.Blocks {
+			nestedScope.Blocks[instAddr] = mapDynamicBlocks(coll, len(scope.Iterators), func(obj cty.Value) cty.Value {
+				return dynamicBlockCollection(obj.GetAttr(typeName), nestedS.NestingMode)
+			})
+		}
+		contentBody := blockBody.AppendNewBlock("content", nil).Body()
+		moreDiags := generateDynamicContent(addr, path+typeName+".", typeName, content.Blocks[typeName], nestedS.Block, nestedScope, opts, contentBody)
+		diags = append(diags, moreDiags...)
+	}
+
+	return diags
+}
+
+// dynamicForEachValue returns the value that the for_each expression of a
+// dynamic block must produce in order to generate blocks equivalent to the
+// given nested block value, retaining only the parts of each block that the
+// given content refers to.
+func dynamicForEachValue(v cty.Value, mode tfjson.SchemaNestingMode, content *dynamicContent, schema *tfjson.SchemaBlock) cty.Value {
+	switch mode {
+	case tfjson.SchemaNestingModeMap:
+		if v.IsNull() || v.LengthInt() == 0 {
+			return cty.EmptyObjectVal
+		}
+		attrs := map[string]cty.Value{}
+		for it := v.ElementIterator(); it.Next(); {
+			k, obj := it.Element()
+			attrs[k.AsString()] = dynamicContentValue(obj, content, schema)
+		}
+		return cty.ObjectVal(attrs)
+	default:
+		objs := nestedBlockObjects(v, mode)
+		if len(objs) == 0 {
+			return cty.EmptyTupleVal
+		}
+		elems := make([]cty.Value, len(objs))
+		for i, obj := range objs {
+			elems[i] = dynamicContentValue(obj, content, schema)
+		}
+		return cty.TupleVal(elems)
+	}
+}
+
+// dynamicContentValue returns a copy of the given nested block object that
+// includes only the arguments and nested blocks the given content refers to.
+func dynamicContentValue(obj cty.Value, content *dynamicContent, schema *tfjson.SchemaBlock) cty.Value {
+	attrs := map[string]cty.Value{}
+	for _, name := range content.Attrs {
+		attrs[name] = obj.GetAttr(name)
+	}
+	for _, typeName := range content.BlockNames {
+		nestedS := schema.NestedBlocks[typeName]
+		nestedV := obj.GetAttr(typeName)
+		if nestedS.NestingMode == tfjson.SchemaNestingModeSingle {
+			if nestedV.IsNull() {
+				attrs[typeName] = cty.NullVal(cty.DynamicPseudoType)
+			} else {
+				attrs[typeName] = dynamicContentValue(nestedV, content.Blocks[typeName], nestedS.Block)
+			}
+			continue
+		}
+		attrs[typeName] = dynamicForEachValue(nestedV, nestedS.NestingMode, content.Blocks[typeName], nestedS.Block)
+	}
+	return cty.ObjectVal(attrs)
+}
+
+// dynamicBlockCollection returns the objects representing the individual
+// blocks in the given nested block value as a collection shaped like the
+// for_each value that dynamicForEachValue would produce for it: an object
+// keyed by label for map nesting, or otherwise a tuple.
+func dynamicBlockCollection(v cty.Value, mode tfjson.SchemaNestingMode) cty.Value {
+	if mode == tfjson.SchemaNestingModeMap {
+		if v.IsNull() || v.LengthInt() == 0 {
+			return cty.EmptyObjectVal
+		}
+		return cty.ObjectVal(v.AsValueMap())
+	}
+	objs := nestedBlockObjects(v, mode)
+	if len(objs) == 0 {
+		return cty.EmptyTupleVal
+	}
+	return cty.TupleVal(objs)
+}
+
+// mapDynamicBlocks calls the given function for each of the block objects
+// nested the given number of levels deep in the given collection from
+// dynamicBlockCollection, returning a collection of the same shape
+// containing the results.
+func mapDynamicBlocks(coll cty.Value, depth int, f func(obj cty.Value) cty.Value) cty.Value {
+	if depth == 0 {
+		return f(coll)
+	}
+	ty := coll.Type()
+	if ty.IsObjectType() {
+		attrs := make(map[string]cty.Value, coll.LengthInt())
+		for it := coll.ElementIterator(); it.Next(); {
+			k, elem := it.Element()
+			attrs[k.AsString()] = mapDynamicBlocks(elem, depth-1, f)
+		}
+		if len(attrs) == 0 {
+			return cty.EmptyObjectVal
+		}
+		return cty.ObjectVal(attrs)
+	}
+	elems := make([]cty.Value, 0, coll.LengthInt())
+	for it := coll.ElementIterator(); it.Next(); {
+		_, elem := it.Element()
+		elems = append(elems, mapDynamicBlocks(elem, depth-1, f))
+	}
+	if len(elems) == 0 {
+		return cty.EmptyTupleVal
+	}
+	return cty.TupleVal(elems)
+}
+
+// nestedBlockObjects returns the objects representing the individual blocks
+// in the given nested block value, which has the given nesting mode.
+func nestedBlockObjects(v cty.Value, mode tfjson.SchemaNestingMode) []cty.Value {
+	if v.IsNull() {
+		return nil
+	}
+	switch mode {
+	case tfjson.SchemaNestingModeSingle:
+		return []cty.Value{v}
+	case tfjson.SchemaNestingModeMap:
+		m := v.AsValueMap()
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ret := make([]cty.Value, len(keys))
+		for i, k := range keys {
+			ret[i] = m[k]
+		}
+		return ret
+	default:
+		return v.AsValueSlice()
+	}
+}
+
+// setDynamicLabels sets the labels argument of a dynamic block for a nested
+// block type with map nesting, where the label is the map key.
+func setDynamicLabels(body *hclwrite.Body, iterator string) {
+	tokens := hclwrite.Tokens{
+		{Type: hclsyntax.TokenOBrack, Bytes: []byte{'['}},
+	}
+	tokens = append(tokens, hclwrite.TokensForTraversal(hcl.Traversal{
+		hcl.TraverseRoot{Name: iterator},
+		hcl.TraverseAttr{Name: "key"},
+	})...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte{']'}})
+	body.SetAttributeRaw("labels", tokens)
+}
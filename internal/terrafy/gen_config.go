@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
@@ -13,7 +14,117 @@ import (
 	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
-func generateResourceConfig(addr resourceAddr, instances map[resourceInstanceAddr]*tfjson.StateResource, schema *tfjson.Schema, body *hclwrite.Body) hcl.Diagnostics {
+// genOptions customize how generateResourceConfig generates the configuration
+// for a particular resource.
+type genOptions struct {
+	// ElideZeroValues is from the field of the same name in Settings.
+	ElideZeroValues bool
+
+	// KeepZeroValues is the set of argument paths from the field of the same
+	// name in Settings that apply to the resource type being generated.
+	KeepZeroValues map[string]bool
+
+	// SkipArguments is the set of argument and nested block paths that
+	// we must never generate, from both builtinSkipArguments and the
+	// field of the same name in Settings.
+	SkipArguments map[string]bool
+
+	// ReservedVariables are the names of input variables that already
+	// exist, which generateResourceConfig must avoid when declaring new ones.
+	// generateResourceConfig adds the names of its own variables here too.
+	ReservedVariables map[string]bool
+
+	// Variables are the input variables that generateResourceConfig
+	// declared in place of sensitive arguments, which the caller must then
+	// add to the configuration.
+	Variables []generatedVariable
+
+	// References, if set, is used to generate references to other imported
+	// resources in place of values that match their identifying attributes.
+	References *referenceIndex
+
+	// LocalValues, if set, causes arguments whose values differ between
+	// the instances of a resource using for_each to refer to attributes of
+	// each.value instead of using lookup tables. The map is keyed by instance
+	// key, and generateResourceConfig adds the values of those attributes to
+	// it so that the caller can declare the local value for for_each.
+	LocalValues map[string]map[string]cty.Value
+	localAttrs  map[string]string // local value attribute names by value path
+	localNames  map[string]bool   // the attribute names used in localAttrs
+
+	// valuePrefix identifies the nested block that we're currently
+	// generating, including its position or label, as a prefix for the
+	// value paths of its arguments. Unlike the paths used for matching
+	// settings, value paths distinguish between blocks of the same type.
+	valuePrefix string
+
+	// OnlyArguments, if not nil, is the set of argument and nested block
+	// paths from the only_attributes argument of the import block, which
+	// are the only optional ones that we may generate.
+	OnlyArguments map[string]bool
+
+	// Overrides are the source code of expressions from the override block
+	// of the import block, keyed by argument path, which we generate instead
+	// of the imported values.
+	Overrides     map[string]string
+	usedOverrides map[string]bool
+}
+
+// builtinSkipArguments are arguments that providers report as optional but
+// that can't actually be set in the configuration, keyed by provider type
+// name. The entries under the empty string apply to all providers.
+var builtinSkipArguments = map[string][]string{
+	// The legacy SDK reports "id" as optional and computed for every
+	// managed resource type, but then rejects it during validation.
+	"": {"id"},
+}
+
+// newGenOptions returns the options for generating the configuration for
+// the given resource under the given settings. providerAddr is the address
+// of the provider that the resource belongs to, as recorded in the state.
+func newGenOptions(settings *Settings, addr resourceAddr, providerAddr string) *genOptions {
+	ret := &genOptions{
+		ElideZeroValues: settings.ElideZeroValues,
+		KeepZeroValues:  map[string]bool{},
+		SkipArguments:   map[string]bool{},
+
+		ReservedVariables: map[string]bool{},
+	}
+	for _, path := range settings.KeepZeroValues[addr.Type] {
+		ret.KeepZeroValues[path] = true
+	}
+
+	providerType := providerTypeName(providerAddr)
+	for _, paths := range [][]string{
+		builtinSkipArguments[""],
+		builtinSkipArguments[providerType],
+		settings.SkipArguments[providerType],
+	} {
+		for _, path := range paths {
+			ret.SkipArguments[path] = true
+		}
+	}
+	return ret
+}
+
+// providerTypeName returns the type name of the provider with the given
+// address, such as "aws" for registry.terraform.io/hashicorp/aws. Older
+// versions of Terraform record just the type name in the state, and so
+// then the result is the address itself.
+func providerTypeName(providerAddr string) string {
+	if i := strings.LastIndexByte(providerAddr, '/'); i >= 0 {
+		return providerAddr[i+1:]
+	}
+	return providerAddr
+}
+
+// elideZero returns true if an optional argument or nested block with the
+// given path should be omitted whenever all of its values are zero values.
+func (o *genOptions) elideZero(path string) bool {
+	return o.ElideZeroValues && !o.KeepZeroValues[path]
+}
+
+func generateResourceConfig(addr resourceAddr, instances map[resourceInstanceAddr]*tfjson.StateResource, schema *tfjson.Schema, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 
 	// The data format in tfjson.StateResource is pretty inconvenient for our
@@ -51,12 +162,136 @@ func generateResourceConfig(addr resourceAddr, instances map[resourceInstanceAdd
 		instVals[addr] = obj
 	}
 
-	moreDiags := generateConfigBody(addr, instVals, schema.Block, body)
+	instVals, moreDiags := mergeModuleInstances(addr, instVals, schema.Block, opts)
 	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return diags
+	}
+
+	moreDiags = generateConfigBody(addr, "", instVals, schema.Block, opts, body)
+	diags = append(diags, moreDiags...)
+	diags = append(diags, opts.unusedOverrides(addr)...)
 	return diags
 }
 
-func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlock, body *hclwrite.Body) hcl.Diagnostics {
+// mergeModuleInstances deals with a resource whose instances belong to more
+// than one instance of its module, by returning just one value for each
+// resource instance key.
+//
+// All instances of a module share the same resource block, which can only
+// vary its arguments by the resource's own instance key, so the instances
+// with the same key in different module instances must agree about all of
+// the arguments that we'd generate. If they don't, the result has error
+// diagnostics.
+func mergeModuleInstances(addr resourceAddr, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlock, opts *genOptions) (map[resourceInstanceAddr]cty.Value, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	modules := map[string]bool{}
+	instAddrs := make([]resourceInstanceAddr, 0, len(vals))
+	for instAddr := range vals {
+		modules[instAddr.Resource.Module] = true
+		instAddrs = append(instAddrs, instAddr)
+	}
+	if len(modules) < 2 {
+		return vals, diags
+	}
+	sort.Slice(instAddrs, func(i, j int) bool {
+		return instAddrs[i].String() < instAddrs[j].String()
+	})
+
+	ret := make(map[resourceInstanceAddr]cty.Value)
+	byKey := make(map[interface{}]resourceInstanceAddr)
+	for _, instAddr := range instAddrs {
+		first, exists := byKey[instAddr.InstanceKey]
+		if !exists {
+			byKey[instAddr.InstanceKey] = instAddr
+			ret[instAddr] = vals[instAddr]
+			continue
+		}
+		if path := configDifference(vals[first], vals[instAddr], "", schema, opts); path != "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Inconsistent module instances",
+				Detail:   fmt.Sprintf("Terrafy can generate only one resource block for %s, shared by all instances of its module, but %s and %s have different values for %s.\n\nImport into only one instance of the module, or use ignore_attributes or an override block to avoid generating %s from the imported values.", addr, first, instAddr, path, path),
+			})
+		}
+	}
+	return ret, diags
+}
+
+// configDifference compares the parts of the given values that we'd
+// generate configuration for, returning the path of the first argument or
+// nested block where they differ, or an empty string if they don't.
+func configDifference(a, b cty.Value, path string, schema *tfjson.SchemaBlock, opts *genOptions) string {
+	if a.IsNull() || b.IsNull() {
+		if a.IsNull() != b.IsNull() {
+			return strings.TrimSuffix(path, ".")
+		}
+		return ""
+	}
+
+	names := make([]string, 0, len(schema.Attributes)+len(schema.NestedBlocks))
+	for name := range schema.Attributes {
+		names = append(names, name)
+	}
+	for name := range schema.NestedBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if opts.SkipArguments[path+name] {
+			continue
+		}
+		if _, overridden := opts.Overrides[path+name]; overridden {
+			continue
+		}
+		if !a.Type().HasAttribute(name) || !b.Type().HasAttribute(name) {
+			continue
+		}
+		aV, bV := a.GetAttr(name), b.GetAttr(name)
+
+		if attrS, isAttr := schema.Attributes[name]; isAttr {
+			if !(attrS.Required || attrS.Optional) {
+				continue
+			}
+			if !aV.RawEquals(bV) {
+				return path + name
+			}
+			continue
+		}
+
+		nestedS := schema.NestedBlocks[name]
+		if aV.IsNull() != bV.IsNull() {
+			return path + name
+		}
+		if nestedS.NestingMode == tfjson.SchemaNestingModeMap && !aV.IsNull() {
+			for it := aV.ElementIterator(); it.Next(); {
+				k, _ := it.Element()
+				if !bV.HasIndex(k).True() {
+					return path + name
+				}
+			}
+		}
+		aObjs := nestedBlockObjects(aV, nestedS.NestingMode)
+		bObjs := nestedBlockObjects(bV, nestedS.NestingMode)
+		if len(aObjs) != len(bObjs) {
+			return path + name
+		}
+		for i := range aObjs {
+			if diff := configDifference(aObjs[i], bObjs[i], path+name+".", nestedS.Block, opts); diff != "" {
+				return diff
+			}
+		}
+	}
+	return ""
+}
+
+// generateConfigBody generates the arguments and nested blocks for the given
+// values into the given body. The path is empty for the top-level body of a
+// resource block, or otherwise the names of the enclosing nested block types
+// each followed by a period, for matching against genOptions.KeepZeroValues.
+func generateConfigBody(addr resourceAddr, path string, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlock, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 
 	attrNames := make([]string, 0, len(schema.Attributes))
@@ -81,6 +316,18 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 			// This attribute is not assignable in the configuration.
 			continue
 		}
+		if tokens, ok := opts.overrideTokens(path + name); ok {
+			// The user told us what to write instead of the imported values.
+			body.SetAttributeRaw(name, tokens)
+			continue
+		}
+		if opts.SkipArguments[path+name] {
+			// This attribute claims to be assignable, but isn't really.
+			continue
+		}
+		if !attrS.Required && !opts.included(path+name) {
+			continue
+		}
 
 		for instAddr, obj := range vals {
 			if !obj.Type().HasAttribute(name) {
@@ -90,12 +337,31 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 			attrVals[instAddr] = obj.GetAttr(name)
 		}
 
-		moreDiags := generateConfigAttribute(addr, name, attrVals, attrS, body)
+		// Providers built with the legacy SDK tend to report the zero value
+		// of an argument's type as the value of any unset optional argument,
+		// which would otherwise make our result very noisy.
+		if attrS.Optional && !attrS.Required && opts.elideZero(path+name) && allZeroValues(attrVals) {
+			continue
+		}
+
+		if attrS.Sensitive {
+			// We mustn't write secrets into the configuration in cleartext.
+			generateSensitiveAttribute(addr, path, name, attrVals, opts, body)
+			continue
+		}
+
+		moreDiags := generateConfigAttribute(addr, name, opts.valuePrefix+name, attrVals, attrS, opts, body)
 		diags = append(diags, moreDiags...)
 	}
 
 	for _, typeName := range blockTypeNames {
+		if opts.SkipArguments[path+typeName] {
+			continue
+		}
 		nestedS := schema.NestedBlocks[typeName]
+		if nestedS.MinItems == 0 && !opts.included(path+typeName) {
+			continue
+		}
 		switch nestedS.NestingMode {
 		case tfjson.SchemaNestingModeSingle:
 			for instAddr, obj := range vals {
@@ -104,30 +370,64 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 				}
 				attrVals[instAddr] = obj.GetAttr(typeName)
 			}
-			moreDiags := generateConfigBlock(addr, typeName, nil, attrVals, nestedS, body)
-			diags = append(diags, moreDiags...)
+			nullCount := 0
+			for _, v := range attrVals {
+				if v.IsNull() {
+					nullCount++
+				}
+			}
+			switch nullCount {
+			case len(attrVals):
+				// None of the instances have this block, so there's
+				// nothing to generate.
+			case 0:
+				moreDiags := generateConfigBlock(addr, path, typeName, nil, nil, attrVals, nestedS, true, opts, body)
+				diags = append(diags, moreDiags...)
+			default:
+				moreDiags := generateDynamicBlock(addr, path, typeName, attrVals, nestedS, opts, body)
+				diags = append(diags, moreDiags...)
+			}
 		case tfjson.SchemaNestingModeList, tfjson.SchemaNestingModeSet:
 			attrValSlices := make(map[resourceInstanceAddr][]cty.Value, len(attrVals))
 			maxLen := 0
+			minLen := -1
 			for instAddr, obj := range vals {
 				if !obj.Type().HasAttribute(typeName) {
 					attrValSlices[instAddr] = nil
 				}
-				attrValSlices[instAddr] = obj.GetAttr(typeName).AsValueSlice()
-				if l := len(attrValSlices[instAddr]); l > maxLen {
+				attrVals[instAddr] = obj.GetAttr(typeName)
+				attrValSlices[instAddr] = nestedBlockObjects(attrVals[instAddr], nestedS.NestingMode)
+				l := len(attrValSlices[instAddr])
+				if l > maxLen {
 					maxLen = l
 				}
+				if minLen < 0 || l < minLen {
+					minLen = l
+				}
+			}
+
+			if minLen != maxLen {
+				// The instances disagree about how many blocks there are,
+				// so we can't just generate the blocks positionally.
+				moreDiags := generateDynamicBlock(addr, path, typeName, attrVals, nestedS, opts, body)
+				diags = append(diags, moreDiags...)
+				continue
 			}
 
 			for i := 0; i < maxLen; i++ {
 				for instAddr, objs := range attrValSlices {
-					if len(objs) > i {
-						attrVals[instAddr] = objs[i]
-					} else {
-						attrVals[instAddr] = cty.NullVal(schemaBlockImpliedType(nestedS.Block))
-					}
+					attrVals[instAddr] = objs[i]
+				}
+				var key interface{}
+				if maxLen > 1 {
+					key = i
 				}
-				moreDiags := generateConfigBlock(addr, typeName, nil, attrVals, nestedS, body)
+				// Removing one of several blocks would change the position
+				// of the others, so we can only elide a block if it's
+				// the only one. That's the typical case for legacy SDK
+				// providers, which use single-element lists for blocks
+				// that can only appear once.
+				moreDiags := generateConfigBlock(addr, path, typeName, nil, key, attrVals, nestedS, maxLen == 1, opts, body)
 				diags = append(diags, moreDiags...)
 			}
 
@@ -138,11 +438,30 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 				if !obj.Type().HasAttribute(typeName) {
 					attrValMaps[instAddr] = nil
 				}
-				attrValMaps[instAddr] = obj.GetAttr(typeName).AsValueMap()
+				attrVals[instAddr] = obj.GetAttr(typeName)
+				if !attrVals[instAddr].IsNull() {
+					attrValMaps[instAddr] = attrVals[instAddr].AsValueMap()
+				}
 				for k := range attrValMaps[instAddr] {
 					allKeys[k] = struct{}{}
 				}
 			}
+
+			consistent := true
+			for _, objs := range attrValMaps {
+				if len(objs) != len(allKeys) {
+					consistent = false
+					break
+				}
+			}
+			if !consistent {
+				// The instances disagree about which blocks there are,
+				// so we can't just generate one block per key.
+				moreDiags := generateDynamicBlock(addr, path, typeName, attrVals, nestedS, opts, body)
+				diags = append(diags, moreDiags...)
+				continue
+			}
+
 			allKeyNames := make([]string, 0, len(allKeys))
 			for k := range allKeys {
 				allKeyNames = append(allKeyNames, k)
@@ -156,7 +475,7 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 						attrVals[instAddr] = cty.NullVal(schemaBlockImpliedType(nestedS.Block))
 					}
 				}
-				moreDiags := generateConfigBlock(addr, typeName, []string{k}, attrVals, nestedS, body)
+				moreDiags := generateConfigBlock(addr, path, typeName, []string{k}, k, attrVals, nestedS, false, opts, body)
 				diags = append(diags, moreDiags...)
 			}
 		}
@@ -165,26 +484,27 @@ func generateConfigBody(addr resourceAddr, vals map[resourceInstanceAddr]cty.Val
 	return diags
 }
 
-func generateConfigAttribute(addr resourceAddr, name string, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaAttribute, body *hclwrite.Body) hcl.Diagnostics {
+// generateConfigAttribute generates an argument with the given name that
+// produces the given values for each of the instances. The value path is the
+// argument's path for the purposes of genOptions, which identifies the value
+// in the local value generated for the "locals" for_each style.
+func generateConfigAttribute(addr resourceAddr, name string, valuePath string, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaAttribute, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 
+	// If the value is the id of another object we imported then referring
+	// to it will tell Terraform about the dependency between them.
+	if schema != nil && opts.References != nil {
+		if tokens, ok := opts.References.referenceTokens(addr, name, vals); ok {
+			body.SetAttributeRaw(name, tokens)
+			return diags
+		}
+	}
+
 	// In the ideal case all of the values are equal and so we can just generate
 	// a constant expression. However, we'll end up with this as cty.NilVal
 	// if we find that the values are inconsistent between instances because
 	// that'll mean we need to generate a dynamic selection expression instead.
-	var singleVal cty.Value
-	for _, v := range vals {
-		if singleVal == cty.NilVal {
-			singleVal = v
-			continue
-		}
-		if !singleVal.RawEquals(v) {
-			// We've found a difference, so we can't just use a constant.
-			singleVal = cty.NilVal
-			break
-		}
-	}
-
+	singleVal := singleValue(vals)
 	if singleVal != cty.NilVal {
 		// Easy case!
 		if !singleVal.IsNull() {
@@ -193,21 +513,36 @@ func generateConfigAttribute(addr resourceAddr, name string, vals map[resourceIn
 		return diags
 	}
 
-	// If we don't have the same value for all instances then we have to
-	// generate a dynamic lookup based on the instance key. We don't have
-	// enough information to generate the sort of dynamic lookup an end-user
-	// would typically write, so we'll just generate a straightforward
-	// (but very ugly) table lookup based on either count.index or each.key,
-	// depending on which repetition mode this resource uses.
-	var indexTraversal hcl.Traversal
+	// The values often differ in a systematic way, such as by including the
+	// instance key, which we can then express directly.
+	if schema != nil {
+		if tokens, ok := inferPatternTokens(vals); ok {
+			body.SetAttributeRaw(name, tokens)
+			return diags
+		}
+	}
+
+	// If we're generating a local value with an object for each instance
+	// then we can put the values in there.
+	if opts.LocalValues != nil && opts.addLocalValues(valuePath, vals) {
+		body.SetAttributeTraversal(name, hcl.Traversal{
+			hcl.TraverseRoot{Name: "each"},
+			hcl.TraverseAttr{Name: "value"},
+			hcl.TraverseAttr{Name: opts.localValueAttr(valuePath)},
+		})
+		return diags
+	}
+
+	// Otherwise we have to generate a dynamic lookup based on the instance
+	// key. We don't have enough information to generate the sort of dynamic
+	// lookup an end-user would typically write, so we'll just generate a
+	// straightforward (but very ugly) table lookup based on either
+	// count.index or each.key, depending on which repetition mode this
+	// resource uses.
 	var brackets [2]*hclwrite.Token
 	for k := range vals {
 		switch k.InstanceKey.(type) {
 		case int:
-			indexTraversal = hcl.Traversal{
-				hcl.TraverseRoot{Name: "count"},
-				hcl.TraverseAttr{Name: "index"},
-			}
 			brackets[0] = &hclwrite.Token{
 				Type:  hclsyntax.TokenOBrack,
 				Bytes: []byte{'['},
@@ -217,10 +552,6 @@ func generateConfigAttribute(addr resourceAddr, name string, vals map[resourceIn
 				Bytes: []byte{']'},
 			}
 		case string:
-			indexTraversal = hcl.Traversal{
-				hcl.TraverseRoot{Name: "each"},
-				hcl.TraverseAttr{Name: "key"},
-			}
 			brackets[0] = &hclwrite.Token{
 				Type:  hclsyntax.TokenOBrace,
 				Bytes: []byte{'{'},
@@ -234,28 +565,8 @@ func generateConfigAttribute(addr resourceAddr, name string, vals map[resourceIn
 		}
 		break
 	}
-	indexTokens := hclwrite.TokensForTraversal(indexTraversal)
-
-	keys := make([]interface{}, 0, len(vals))
-	vVals := make(map[interface{}]cty.Value, len(vals))
-	for addr, v := range vals {
-		keys = append(keys, addr.InstanceKey)
-		vVals[addr.InstanceKey] = v
-	}
-	sort.Slice(keys, func(i, j int) bool {
-		iInt, iIsInt := keys[i].(int)
-		jInt, jIsInt := keys[j].(int)
-		iStr, _ := keys[i].(string)
-		jStr, _ := keys[j].(string)
-		switch {
-		case iIsInt != jIsInt:
-			return iIsInt
-		case iIsInt:
-			return iInt < jInt
-		default:
-			return iStr < jStr
-		}
-	})
+	indexTokens := hclwrite.TokensForTraversal(instanceKeyTraversal(vals))
+	keys, vVals := valuesByInstanceKey(vals)
 
 	var tokens hclwrite.Tokens
 	tokens = append(tokens, brackets[0])
@@ -301,7 +612,140 @@ func generateConfigAttribute(addr resourceAddr, name string, vals map[resourceIn
 	return diags
 }
 
-func generateConfigBlock(addr resourceAddr, typeName string, labels []string, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlockType, body *hclwrite.Body) hcl.Diagnostics {
+// singleValue returns the value that all of the given values are equal to,
+// or cty.NilVal if they are not all equal.
+func singleValue(vals map[resourceInstanceAddr]cty.Value) cty.Value {
+	var singleVal cty.Value
+	for _, v := range vals {
+		if singleVal == cty.NilVal {
+			singleVal = v
+			continue
+		}
+		if !singleVal.RawEquals(v) {
+			return cty.NilVal
+		}
+	}
+	return singleVal
+}
+
+// instanceKeyTraversal returns the traversal that refers to the current
+// instance key from inside the configuration of the resource that the given
+// values belong to, which is either count.index or each.key.
+func instanceKeyTraversal(vals map[resourceInstanceAddr]cty.Value) hcl.Traversal {
+	for k := range vals {
+		switch k.InstanceKey.(type) {
+		case int:
+			return hcl.Traversal{
+				hcl.TraverseRoot{Name: "count"},
+				hcl.TraverseAttr{Name: "index"},
+			}
+		case string:
+			return hcl.Traversal{
+				hcl.TraverseRoot{Name: "each"},
+				hcl.TraverseAttr{Name: "key"},
+			}
+		default:
+			panic(fmt.Sprintf("unexpected instance key type %T", k.InstanceKey))
+		}
+	}
+	return nil
+}
+
+// valuesByInstanceKey returns the instance keys of the given values in
+// a consistent order, along with the values keyed by those instance keys.
+func valuesByInstanceKey(vals map[resourceInstanceAddr]cty.Value) ([]interface{}, map[interface{}]cty.Value) {
+	keys := make([]interface{}, 0, len(vals))
+	vVals := make(map[interface{}]cty.Value, len(vals))
+	for addr, v := range vals {
+		keys = append(keys, addr.InstanceKey)
+		vVals[addr.InstanceKey] = v
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iInt, iIsInt := keys[i].(int)
+		jInt, jIsInt := keys[j].(int)
+		iStr, _ := keys[i].(string)
+		jStr, _ := keys[j].(string)
+		switch {
+		case iIsInt != jIsInt:
+			return iIsInt
+		case iIsInt:
+			return iInt < jInt
+		default:
+			return iStr < jStr
+		}
+	})
+	return keys, vVals
+}
+
+// generateConfigBlock generates a nested block of the given type into the
+// given body. If elidable is true and the block ends up empty after eliding
+// zero values then it removes the block again.
+//
+// key is the position (an int) or label (a string) that distinguishes the
+// block from any others of the same type, or nil if it's the only one.
+func generateConfigBlock(addr resourceAddr, path string, typeName string, labels []string, key interface{}, vals map[resourceInstanceAddr]cty.Value, schema *tfjson.SchemaBlockType, elidable bool, opts *genOptions, body *hclwrite.Body) hcl.Diagnostics {
+	outerPrefix := opts.valuePrefix
+	switch key := key.(type) {
+	case int:
+		opts.valuePrefix = fmt.Sprintf("%s%s[%d].", outerPrefix, typeName, key)
+	case string:
+		opts.valuePrefix = fmt.Sprintf("%s%s[%q].", outerPrefix, typeName, key)
+	default:
+		opts.valuePrefix = outerPrefix + typeName + "."
+	}
 	block := body.AppendNewBlock(typeName, labels)
-	return generateConfigBody(addr, vals, schema.Block, block.Body())
+	diags := generateConfigBody(addr, path+typeName+".", vals, schema.Block, opts, block.Body())
+	opts.valuePrefix = outerPrefix
+
+	// If we elided everything inside an optional block then the block itself
+	// is probably just more noise.
+	blockBody := block.Body()
+	if elidable && schema.MinItems == 0 && opts.elideZero(path+typeName) && len(blockBody.Attributes()) == 0 && len(blockBody.Blocks()) == 0 {
+		body.RemoveBlock(block)
+	}
+	return diags
+}
+
+// allZeroValues returns true if all of the given values are either null or
+// the zero value of their type, as decided by isZeroValue.
+func allZeroValues(vals map[resourceInstanceAddr]cty.Value) bool {
+	for _, v := range vals {
+		if !isZeroValue(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// isZeroValue returns true if the given value is null or is the zero value
+// of its type: an empty string, the number zero, false, an empty collection,
+// or an object whose attributes are all zero values.
+func isZeroValue(v cty.Value) bool {
+	if v.IsNull() {
+		return true
+	}
+	if !v.IsKnown() {
+		return false
+	}
+	ty := v.Type()
+	switch {
+	case ty == cty.String:
+		return v.AsString() == ""
+	case ty == cty.Number:
+		return v.Equals(cty.Zero).True()
+	case ty == cty.Bool:
+		return v.False()
+	case ty.IsListType() || ty.IsSetType() || ty.IsMapType() || ty.IsTupleType():
+		return v.LengthInt() == 0
+	case ty.IsObjectType():
+		for it := v.ElementIterator(); it.Next(); {
+			_, attrVal := it.Element()
+			if !isZeroValue(attrVal) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,167 @@
+package terrafy
+
+import (
+	"strings"
+	"testing"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestMergeModuleInstances(t *testing.T) {
+	schema := &tfjson.SchemaBlock{
+		Attributes: map[string]*tfjson.SchemaAttribute{
+			"id":   {AttributeType: cty.String, Computed: true},
+			"name": {AttributeType: cty.String, Optional: true},
+		},
+		NestedBlocks: map[string]*tfjson.SchemaBlockType{
+			"rule": {
+				NestingMode: tfjson.SchemaNestingModeList,
+				Block: &tfjson.SchemaBlock{
+					Attributes: map[string]*tfjson.SchemaAttribute{
+						"port": {AttributeType: cty.Number, Optional: true},
+					},
+				},
+			},
+			"tag": {
+				NestingMode: tfjson.SchemaNestingModeMap,
+				Block: &tfjson.SchemaBlock{
+					Attributes: map[string]*tfjson.SchemaAttribute{
+						"value": {AttributeType: cty.String, Optional: true},
+					},
+				},
+			},
+		},
+	}
+	obj := func(id, name string, ports []int64, tags map[string]string) cty.Value {
+		rules := make([]cty.Value, len(ports))
+		for i, port := range ports {
+			rules[i] = cty.ObjectVal(map[string]cty.Value{"port": cty.NumberIntVal(port)})
+		}
+		ruleTy := cty.List(cty.Object(map[string]cty.Type{"port": cty.Number}))
+		rulesVal := cty.ListValEmpty(ruleTy.ElementType())
+		if len(rules) != 0 {
+			rulesVal = cty.ListVal(rules)
+		}
+		tagTy := cty.Object(map[string]cty.Type{"value": cty.String})
+		tagsVal := cty.MapValEmpty(tagTy)
+		if len(tags) != 0 {
+			tagVals := map[string]cty.Value{}
+			for k, v := range tags {
+				tagVals[k] = cty.ObjectVal(map[string]cty.Value{"value": cty.StringVal(v)})
+			}
+			tagsVal = cty.MapVal(tagVals)
+		}
+		return cty.ObjectVal(map[string]cty.Value{
+			"id":   cty.StringVal(id),
+			"name": cty.StringVal(name),
+			"rule": rulesVal,
+			"tag":  tagsVal,
+		})
+	}
+
+	tests := map[string]struct {
+		vals     map[string]cty.Value // keyed by module instance
+		opts     *genOptions
+		want     int    // number of values in the result
+		wantDiff string // empty if we expect no error
+	}{
+		"one module instance": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", []int64{80}, nil),
+			},
+			want: 1,
+		},
+		"identical": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", []int64{80, 443}, map[string]string{"env": "prod"}),
+				`module.a["y"]`: obj("i-2", "web", []int64{80, 443}, map[string]string{"env": "prod"}),
+				`module.a["z"]`: obj("i-3", "web", []int64{80, 443}, map[string]string{"env": "prod"}),
+			},
+			want: 1,
+		},
+		"argument differs in the last instance": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", nil, nil),
+				`module.a["y"]`: obj("i-2", "web", nil, nil),
+				`module.a["z"]`: obj("i-3", "db", nil, nil),
+			},
+			wantDiff: "name",
+		},
+		"nested block argument differs": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", []int64{80, 443}, nil),
+				`module.a["y"]`: obj("i-2", "web", []int64{80, 8443}, nil),
+			},
+			wantDiff: "rule.port",
+		},
+		"different number of nested blocks": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", []int64{80}, nil),
+				`module.a["y"]`: obj("i-2", "web", []int64{80, 443}, nil),
+			},
+			wantDiff: "rule",
+		},
+		"different nested block keys": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", nil, map[string]string{"env": "prod"}),
+				`module.a["y"]`: obj("i-2", "web", nil, map[string]string{"stage": "prod"}),
+			},
+			wantDiff: "tag",
+		},
+		"skipped argument": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", nil, nil),
+				`module.a["y"]`: obj("i-2", "db", nil, nil),
+			},
+			opts: &genOptions{SkipArguments: map[string]bool{"name": true}},
+			want: 1,
+		},
+		"overridden argument": {
+			vals: map[string]cty.Value{
+				`module.a["x"]`: obj("i-1", "web", []int64{80}, nil),
+				`module.a["y"]`: obj("i-2", "web", []int64{443}, nil),
+			},
+			opts: &genOptions{Overrides: map[string]string{"rule.port": "var.port"}},
+			want: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr := resourceAddr{
+				Module: "module.a",
+				Mode:   tfjson.ManagedResourceMode,
+				Type:   "test_thing",
+				Name:   "test",
+			}
+			vals := map[resourceInstanceAddr]cty.Value{}
+			for module, v := range test.vals {
+				instAddr := resourceInstanceAddr{Resource: addr}
+				instAddr.Resource.Module = module
+				vals[instAddr] = v
+			}
+			opts := test.opts
+			if opts == nil {
+				opts = &genOptions{}
+			}
+
+			got, diags := mergeModuleInstances(addr, vals, schema, opts)
+			if test.wantDiff != "" {
+				if !diags.HasErrors() {
+					t.Fatalf("unexpected success; want a difference in %s", test.wantDiff)
+				}
+				if want := "different values for " + test.wantDiff + "."; !strings.Contains(diags[0].Detail, want) {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", diags[0].Detail, want)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			if len(got) != test.want {
+				t.Fatalf("wrong number of values %d; want %d", len(got), test.want)
+			}
+		})
+	}
+}
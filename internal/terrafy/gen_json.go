@@ -0,0 +1,538 @@
+package terrafy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// isJSONConfigFile returns true if the given configuration file uses the
+// JSON variant of the Terraform language.
+func isJSONConfigFile(filename string) bool {
+	return strings.HasSuffix(filename, ".tf.json")
+}
+
+// jsonObject is a JSON object that preserves the order of its properties,
+// so that we can add to an existing file without reordering everything
+// that was already there.
+type jsonObject []jsonProperty
+
+type jsonProperty struct {
+	Name  string
+	Value json.RawMessage
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, prop := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(prop.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(prop.Value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeJSONObject decodes the given JSON source as an object, or returns
+// false if it isn't an object.
+func decodeJSONObject(src []byte) (jsonObject, bool) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+	var ret jsonObject
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		name, ok := tok.(string)
+		if !ok {
+			return nil, false
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, false
+		}
+		ret = append(ret, jsonProperty{Name: name, Value: raw})
+	}
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('}') {
+		return nil, false
+	}
+	return ret, true
+}
+
+func (o *jsonObject) add(name string, v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		// Should never happen, because we only add values we built.
+		panic(fmt.Sprintf("can't encode %s as JSON: %s", name, err))
+	}
+	*o = append(*o, jsonProperty{Name: name, Value: raw})
+}
+
+func (o jsonObject) index(name string) int {
+	for i, prop := range o {
+		if prop.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeJSONObject adds the properties of b to a. Where both have a property
+// of the same name, and we've not yet descended through the given number of
+// levels, it merges the two values if they are both objects, or appends
+// the value from b if the value in a is an array of objects. That matches
+// the ways that the Terraform JSON syntax allows writing several blocks of
+// the same type.
+func mergeJSONObject(a, b jsonObject, depth int) (jsonObject, error) {
+	for _, prop := range b {
+		i := a.index(prop.Name)
+		if i < 0 {
+			a = append(a, prop)
+			continue
+		}
+		if depth == 0 {
+			return nil, fmt.Errorf("there is already a property named %q", prop.Name)
+		}
+		existing := bytes.TrimSpace(a[i].Value)
+		switch {
+		case len(existing) != 0 && existing[0] == '[':
+			var elems []json.RawMessage
+			if err := json.Unmarshal(existing, &elems); err != nil {
+				return nil, err
+			}
+			elems = append(elems, prop.Value)
+			raw, err := json.Marshal(elems)
+			if err != nil {
+				return nil, err
+			}
+			a[i].Value = raw
+		default:
+			aObj, ok := decodeJSONObject(existing)
+			if !ok {
+				return nil, fmt.Errorf("property %q must be an object or an array", prop.Name)
+			}
+			bObj, ok := decodeJSONObject(prop.Value)
+			if !ok {
+				return nil, fmt.Errorf("property %q must be an object", prop.Name)
+			}
+			merged, err := mergeJSONObject(aObj, bObj, depth-1)
+			if err != nil {
+				return nil, fmt.Errorf("in %q, %s", prop.Name, err)
+			}
+			raw, err := json.Marshal(merged)
+			if err != nil {
+				return nil, err
+			}
+			a[i].Value = raw
+		}
+	}
+	return a, nil
+}
+
+// jsonConfigNames returns the names of the input variables and local values
+// declared in the given JSON configuration source, so that we can avoid
+// declaring new ones with the same names.
+func jsonConfigNames(src []byte) (variables, locals []string) {
+	root, ok := decodeJSONObject(src)
+	if !ok {
+		return nil, nil
+	}
+	for _, prop := range root {
+		if prop.Name != "variable" && prop.Name != "locals" {
+			continue
+		}
+		// Each of these can be either an object or an array of objects.
+		var objs []json.RawMessage
+		if err := json.Unmarshal(prop.Value, &objs); err != nil {
+			objs = []json.RawMessage{prop.Value}
+		}
+		for _, raw := range objs {
+			obj, ok := decodeJSONObject(raw)
+			if !ok {
+				continue
+			}
+			for _, inner := range obj {
+				if prop.Name == "variable" {
+					variables = append(variables, inner.Name)
+				} else {
+					locals = append(locals, inner.Name)
+				}
+			}
+		}
+	}
+	return variables, locals
+}
+
+// shadowJSONConfig returns a native syntax file declaring the input
+// variables and local values that the given JSON configuration source
+// declares, so that we can generate into it with hclwrite in the same way as
+// for a native file, and then convert the new blocks to JSON.
+func shadowJSONConfig(src []byte) *hclwrite.File {
+	f := hclwrite.NewEmptyFile()
+	variables, locals := jsonConfigNames(src)
+	for _, name := range variables {
+		f.Body().AppendNewBlock("variable", []string{name})
+	}
+	if len(locals) != 0 {
+		body := f.Body().AppendNewBlock("locals", nil).Body()
+		for _, name := range locals {
+			body.SetAttributeValue(name, cty.NullVal(cty.DynamicPseudoType))
+		}
+	}
+	return f
+}
+
+// writeJSONConfig converts the given blocks generated in native syntax into
+// the JSON variant of the Terraform language, and then adds them to the
+// given JSON configuration file.
+func writeJSONConfig(filename string, blocks []*hclwrite.Block) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	newFile := hclwrite.NewEmptyFile()
+	for _, block := range blocks {
+		newFile.Body().AppendBlock(block)
+	}
+	newSrc := newFile.Bytes()
+	parsed, moreDiags := hclsyntax.ParseConfig(newSrc, filename, hcl.InitialPos)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		// Should never happen, because we just generated this.
+		return diags
+	}
+	syntaxBody := parsed.Body.(*hclsyntax.Body)
+	newObj := jsonFileBody(syntaxBody, newSrc)
+
+	// We can't attach comments to particular parts of a JSON object, so we
+	// collect up any comments we generated, such as the IMPORT-TODO
+	// reminders, and put them all in the special "//" property of the
+	// block they belong to. The parsed blocks are in the same order as
+	// the ones we were given.
+	for i, block := range blocks {
+		comments := blockComments(block)
+		if len(comments) == 0 || i >= len(syntaxBody.Blocks) {
+			continue
+		}
+		syntaxBlock := syntaxBody.Blocks[i]
+		newObj = addJSONComment(newObj, append([]string{syntaxBlock.Type}, syntaxBlock.Labels...), comments)
+	}
+
+	var oldSrc []byte
+	if src, err := ioutil.ReadFile(filename); err == nil {
+		oldSrc = src
+	}
+	root := jsonObject{}
+	if len(bytes.TrimSpace(oldSrc)) != 0 {
+		existing, ok := decodeJSONObject(oldSrc)
+		if !ok {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid JSON configuration file",
+				Detail:   fmt.Sprintf("Terrafy can't add to %s, because its content isn't a JSON object.", filename),
+			})
+			return diags
+		}
+		root = existing
+	}
+	// A resource is nested two levels deep, under its type, and so that's
+	// as far as we might need to merge.
+	merged, err := mergeJSONObject(root, newObj, 2)
+	if err == nil {
+		var raw []byte
+		raw, err = json.Marshal(merged)
+		if err == nil {
+			var buf bytes.Buffer
+			err = json.Indent(&buf, raw, "", "  ")
+			buf.WriteByte('\n')
+			if err == nil {
+				err = ioutil.WriteFile(filename, buf.Bytes(), 0644)
+			}
+		}
+	}
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to update configuration file",
+			Detail:   fmt.Sprintf("Could not add the generated configuration to %s: %s.", filename, err),
+		})
+	}
+	return diags
+}
+
+// blockComments returns the text of all of the comments in the given block.
+func blockComments(block *hclwrite.Block) []string {
+	var ret []string
+	for _, tok := range block.BuildTokens(nil) {
+		if tok.Type != hclsyntax.TokenComment {
+			continue
+		}
+		text := strings.TrimSpace(string(tok.Bytes))
+		switch {
+		case strings.HasPrefix(text, "#"):
+			text = strings.TrimSpace(text[1:])
+		case strings.HasPrefix(text, "//"):
+			text = strings.TrimSpace(text[2:])
+		case strings.HasPrefix(text, "/*"):
+			text = strings.TrimSpace(strings.TrimSuffix(text[2:], "*/"))
+		}
+		ret = append(ret, text)
+	}
+	return ret
+}
+
+// addJSONComment adds the given comments to the "//" property of the block
+// object found by following the given path of property names from the given
+// root object.
+func addJSONComment(root jsonObject, path []string, comments []string) jsonObject {
+	if len(path) == 0 {
+		comment := jsonObject{}
+		comment.add("//", strings.Join(comments, "\n"))
+		return append(comment, root...)
+	}
+	i := root.index(path[0])
+	if i < 0 {
+		return root
+	}
+	obj, ok := decodeJSONObject(root[i].Value)
+	if !ok {
+		return root
+	}
+	obj = addJSONComment(obj, path[1:], comments)
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return root
+	}
+	root[i].Value = raw
+	return root
+}
+
+// jsonFileBody converts the given native syntax file body into a JSON object,
+// using the given source code that it was parsed from.
+func jsonFileBody(body *hclsyntax.Body, src []byte) jsonObject {
+	return jsonBody(body, src, "", true)
+}
+
+// jsonBody converts the given native syntax body into a JSON object, using
+// the given source code that it was parsed from. The path is the names of
+// the enclosing blocks each followed by a period, starting from the
+// resource block, for recognizing the arguments that Terraform treats as
+// static references.
+func jsonBody(body *hclsyntax.Body, src []byte, path string, fileLevel bool) jsonObject {
+	ret := jsonObject{}
+
+	attrs := make([]*hclsyntax.Attribute, 0, len(body.Attributes))
+	for _, attr := range body.Attributes {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].SrcRange.Start.Byte < attrs[j].SrcRange.Start.Byte
+	})
+	for _, attr := range attrs {
+		static := !fileLevel && staticReferenceArguments[path+attr.Name]
+		ret.add(attr.Name, jsonExpr(attr.Expr, src, static))
+	}
+
+	// The JSON syntax groups blocks by type, and then by each of their
+	// labels in turn. Several blocks with the same type and labels are
+	// written as an array.
+	type blockGroup struct {
+		labels []string
+		bodies []jsonObject
+	}
+	var typeNames []string
+	groups := map[string][]*blockGroup{}
+	for _, block := range body.Blocks {
+		childPath := path + block.Type + "."
+		if fileLevel && block.Type == "resource" {
+			childPath = ""
+		}
+		if _, exists := groups[block.Type]; !exists {
+			typeNames = append(typeNames, block.Type)
+		}
+		content := jsonBody(block.Body, src, childPath, false)
+		found := false
+		for _, group := range groups[block.Type] {
+			if strings.Join(group.labels, "\x00") == strings.Join(block.Labels, "\x00") {
+				group.bodies = append(group.bodies, content)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups[block.Type] = append(groups[block.Type], &blockGroup{
+				labels: block.Labels,
+				bodies: []jsonObject{content},
+			})
+		}
+	}
+	for _, typeName := range typeNames {
+		typeObj := jsonObject{}
+		var unlabeled interface{}
+		for _, group := range groups[typeName] {
+			var v interface{} = group.bodies[0]
+			if len(group.bodies) > 1 {
+				v = group.bodies
+			}
+			if len(group.labels) == 0 {
+				unlabeled = v
+				continue
+			}
+			typeObj = nestJSONLabels(typeObj, group.labels, v)
+		}
+		if unlabeled != nil {
+			ret.add(typeName, unlabeled)
+		} else {
+			ret.add(typeName, typeObj)
+		}
+	}
+
+	return ret
+}
+
+// staticReferenceArguments are the arguments that Terraform interprets as
+// references without evaluating them, which the JSON syntax therefore
+// writes as bare strings rather than as templates. The resource block's
+// own arguments have no prefix.
+var staticReferenceArguments = map[string]bool{
+	"provider":                       true,
+	"depends_on":                     true,
+	"lifecycle.ignore_changes":       true,
+	"lifecycle.replace_triggered_by": true,
+}
+
+// nestJSONLabels adds the given value to the given object nested under each
+// of the given labels in turn.
+func nestJSONLabels(obj jsonObject, labels []string, v interface{}) jsonObject {
+	if len(labels) == 1 {
+		obj.add(labels[0], v)
+		return obj
+	}
+	i := obj.index(labels[0])
+	inner := jsonObject{}
+	if i >= 0 {
+		inner, _ = decodeJSONObject(obj[i].Value)
+	}
+	inner = nestJSONLabels(inner, labels[1:], v)
+	raw, err := json.Marshal(inner)
+	if err != nil {
+		panic(fmt.Sprintf("can't encode block as JSON: %s", err))
+	}
+	if i >= 0 {
+		obj[i].Value = raw
+		return obj
+	}
+	return append(obj, jsonProperty{Name: labels[0], Value: raw})
+}
+
+// jsonExpr converts the given native syntax expression into the value that
+// represents it in the JSON syntax, where strings are templates. If static
+// is true then the expression is written as the bare references that
+// Terraform expects for meta-arguments like depends_on.
+func jsonExpr(expr hclsyntax.Expression, src []byte, static bool) interface{} {
+	if static {
+		if tuple, ok := expr.(*hclsyntax.TupleConsExpr); ok {
+			ret := make([]interface{}, len(tuple.Exprs))
+			for i, elem := range tuple.Exprs {
+				ret[i] = exprSource(elem, src)
+			}
+			return ret
+		}
+		return exprSource(expr, src)
+	}
+
+	// Any expression that doesn't refer to anything can be written as the
+	// JSON equivalent of its value.
+	if len(expr.Variables()) == 0 {
+		if v, diags := expr.Value(nil); !diags.HasErrors() && v.IsWhollyKnown() {
+			return jsonValue(v)
+		}
+	}
+
+	switch expr := expr.(type) {
+	case *hclsyntax.TemplateExpr:
+		var buf strings.Builder
+		for _, part := range expr.Parts {
+			if lit, ok := part.(*hclsyntax.LiteralValueExpr); ok && lit.Val.Type() == cty.String {
+				buf.WriteString(escapeJSONTemplate(lit.Val.AsString()))
+				continue
+			}
+			buf.WriteString("${" + exprSource(part, src) + "}")
+		}
+		return buf.String()
+	case *hclsyntax.TemplateWrapExpr:
+		return "${" + exprSource(expr.Wrapped, src) + "}"
+	case *hclsyntax.TupleConsExpr:
+		// Each element of a JSON array is a template in its own right, so
+		// we can convert them separately.
+		ret := make([]interface{}, len(expr.Exprs))
+		for i, elem := range expr.Exprs {
+			ret[i] = jsonExpr(elem, src, false)
+		}
+		return ret
+	default:
+		return "${" + exprSource(expr, src) + "}"
+	}
+}
+
+// jsonValue returns the JSON equivalent of the given known value, escaping
+// any strings so that Terraform won't interpret them as templates.
+func jsonValue(v cty.Value) interface{} {
+	if v.IsNull() {
+		return nil
+	}
+	ty := v.Type()
+	switch {
+	case ty == cty.String:
+		return escapeJSONTemplate(v.AsString())
+	case ty == cty.Number:
+		return json.Number(v.AsBigFloat().Text('f', -1))
+	case ty == cty.Bool:
+		return v.True()
+	case ty.IsObjectType() || ty.IsMapType():
+		ret := jsonObject{}
+		for it := v.ElementIterator(); it.Next(); {
+			k, elem := it.Element()
+			ret.add(escapeJSONTemplate(k.AsString()), jsonValue(elem))
+		}
+		return ret
+	default:
+		ret := make([]interface{}, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, elem := it.Element()
+			ret = append(ret, jsonValue(elem))
+		}
+		return ret
+	}
+}
+
+// escapeJSONTemplate escapes the template sequences in the given literal
+// string, so that a JSON string containing it will produce it verbatim.
+func escapeJSONTemplate(s string) string {
+	s = strings.Replace(s, "${", "$${", -1)
+	s = strings.Replace(s, "%{", "%%{", -1)
+	return s
+}
+
+// exprSource returns the source code of the given expression.
+func exprSource(expr hclsyntax.Expression, src []byte) string {
+	rng := expr.Range()
+	return string(src[rng.Start.Byte:rng.End.Byte])
+}
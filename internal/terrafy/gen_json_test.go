@@ -0,0 +1,254 @@
+package terrafy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestMergeJSONObject(t *testing.T) {
+	tests := map[string]struct {
+		a, b    string
+		depth   int
+		want    string
+		wantErr string
+	}{
+		"new property": {
+			a:     `{"a":1}`,
+			b:     `{"b":2}`,
+			depth: 0,
+			want:  `{"a":1,"b":2}`,
+		},
+		"existing property at depth zero": {
+			a:       `{"a":1}`,
+			b:       `{"a":2}`,
+			depth:   0,
+			wantErr: `there is already a property named "a"`,
+		},
+		"objects merged": {
+			a:     `{"resource":{"test_thing":{"a":{}}}}`,
+			b:     `{"resource":{"test_thing":{"b":{}}}}`,
+			depth: 2,
+			want:  `{"resource":{"test_thing":{"a":{},"b":{}}}}`,
+		},
+		"objects merged only to the given depth": {
+			a:       `{"resource":{"test_thing":{"a":{"x":1}}}}`,
+			b:       `{"resource":{"test_thing":{"a":{"y":2}}}}`,
+			depth:   2,
+			wantErr: `in "resource", in "test_thing", there is already a property named "a"`,
+		},
+		"array appended": {
+			a:     `{"variable":[{"a":{}}]}`,
+			b:     `{"variable":{"b":{}}}`,
+			depth: 1,
+			want:  `{"variable":[{"a":{}},{"b":{}}]}`,
+		},
+		"existing property not an object": {
+			a:       `{"resource":"nope"}`,
+			b:       `{"resource":{}}`,
+			depth:   2,
+			wantErr: `property "resource" must be an object or an array`,
+		},
+		"new property not an object": {
+			a:       `{"resource":{}}`,
+			b:       `{"resource":"nope"}`,
+			depth:   2,
+			wantErr: `property "resource" must be an object`,
+		},
+		"order preserved": {
+			a:     `{"z":{"b":1},"a":{}}`,
+			b:     `{"z":{"a":2},"m":3}`,
+			depth: 1,
+			want:  `{"z":{"b":1,"a":2},"a":{},"m":3}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, ok := decodeJSONObject([]byte(test.a))
+			if !ok {
+				t.Fatalf("invalid a: %s", test.a)
+			}
+			b, ok := decodeJSONObject([]byte(test.b))
+			if !ok {
+				t.Fatalf("invalid b: %s", test.b)
+			}
+			merged, err := mergeJSONObject(a, b, test.depth)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("unexpected success; want error %q", test.wantErr)
+				}
+				if got := err.Error(); got != test.wantErr {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", got, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got, err := json.Marshal(merged)
+			if err != nil {
+				t.Fatalf("failed to encode result: %s", err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("wrong result\ngot:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJSONExpr(t *testing.T) {
+	tests := map[string]struct {
+		src    string
+		static bool
+		want   string
+	}{
+		"string": {
+			src:  `"web"`,
+			want: `"web"`,
+		},
+		"string with interpolation sequence": {
+			src:  `"$${web}"`,
+			want: `"$${web}"`,
+		},
+		"string with directive sequence": {
+			src:  `"%%{ if x }"`,
+			want: `"%%{ if x }"`,
+		},
+		"number": {
+			src:  `8080`,
+			want: `8080`,
+		},
+		"bool": {
+			src:  `true`,
+			want: `true`,
+		},
+		"null": {
+			src:  `null`,
+			want: `null`,
+		},
+		"object": {
+			src:  `{ "$${a}" = "$${b}", c = 1 }`,
+			want: `{"$${a}":"$${b}","c":1}`,
+		},
+		"reference": {
+			src:  `var.name`,
+			want: `"${var.name}"`,
+		},
+		"function call": {
+			src:  `upper(var.name)`,
+			want: `"${upper(var.name)}"`,
+		},
+		"template": {
+			src:  `"web-${var.name}"`,
+			want: `"web-${var.name}"`,
+		},
+		"template with escapes": {
+			src:  `"$${x}-%%{y}-${var.name}"`,
+			want: `"$${x}-%%{y}-${var.name}"`,
+		},
+		"template wrapping a reference": {
+			src:  `"${var.name}"`,
+			want: `"${var.name}"`,
+		},
+		"tuple": {
+			src:  `["$${a}", var.b, 1]`,
+			want: `["$${a}","${var.b}",1]`,
+		},
+		"static reference": {
+			src:    `test.west`,
+			static: true,
+			want:   `"test.west"`,
+		},
+		"static references": {
+			src:    `[test_thing.a, test_thing.b]`,
+			static: true,
+			want:   `["test_thing.a","test_thing.b"]`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := []byte(test.src)
+			expr, diags := hclsyntax.ParseExpression(src, "", hcl.InitialPos)
+			if diags.HasErrors() {
+				t.Fatalf("invalid expression: %s", diags.Error())
+			}
+			got, err := json.Marshal(jsonExpr(expr, src, test.static))
+			if err != nil {
+				t.Fatalf("failed to encode result: %s", err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("wrong result\ngot:  %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteJSONConfig(t *testing.T) {
+	tests := map[string]struct {
+		existing string // no file is created if empty
+		want     string // empty if we expect an error
+	}{
+		"new file": {
+			want: `{"resource":{"test_thing":{"b":{"name":"b"}}}}`,
+		},
+		"same resource type": {
+			existing: `{"resource":{"test_thing":{"a":{"name":"a"}}}}`,
+			want:     `{"resource":{"test_thing":{"a":{"name":"a"},"b":{"name":"b"}}}}`,
+		},
+		"other resource type": {
+			existing: `{"variable":{"x":{}},"resource":{"test_other":{"a":{}}}}`,
+			want:     `{"variable":{"x":{}},"resource":{"test_other":{"a":{}},"test_thing":{"b":{"name":"b"}}}}`,
+		},
+		"resource already declared": {
+			existing: `{"resource":{"test_thing":{"b":{}}}}`,
+		},
+		"not an object": {
+			existing: `[]`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "main.tf.json")
+			if test.existing != "" {
+				if err := ioutil.WriteFile(filename, []byte(test.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			block := hclwrite.NewBlock("resource", []string{"test_thing", "b"})
+			block.Body().SetAttributeValue("name", cty.StringVal("b"))
+			diags := writeJSONConfig(filename, []*hclwrite.Block{block})
+			if test.want == "" {
+				if !diags.HasErrors() {
+					t.Fatal("unexpected success")
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+
+			src, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := json.Compact(&got, src); err != nil {
+				t.Fatalf("invalid result: %s", err)
+			}
+			if got.String() != test.want {
+				t.Fatalf("wrong result\ngot:  %s\nwant: %s", got.String(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package terrafy
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// importBlocksFilename is the name of the file, in the main working directory,
+// where we generate import blocks when running in import blocks mode.
+const importBlocksFilename = "imports.tf"
+
+// checkImportBlocksSupport returns an error diagnostic if the given Terraform
+// CLI is too old to support import blocks in the configuration.
+func checkImportBlocksSupport(tf *tfexec.Terraform) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	ok, tfVersion, err := terraformVersionAtLeast(tf, 1, 5, 0)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to determine Terraform version",
+			Detail:   fmt.Sprintf("Could not determine whether the Terraform CLI supports import blocks: %s.", err),
+		})
+		return diags
+	}
+	if !ok {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Terraform version does not support import blocks",
+			Detail:   fmt.Sprintf("Generating import blocks requires Terraform v1.5.0 or later, but the selected Terraform CLI is v%s.", tfVersion),
+		})
+	}
+	return diags
+}
+
+// checkImportBlocksModules returns an error diagnostic for each import
+// targeting a child module, which import blocks mode doesn't support
+// because we have no way to import into a child module in the temporary
+// working directory.
+func checkImportBlocksModules(cfg *Config) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for addr, imp := range cfg.ImportConfigs {
+		if addr.Module == "" {
+			continue
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Import blocks mode doesn't support child modules",
+			Detail:   fmt.Sprintf("Terrafy cannot yet generate import blocks for %s, because it belongs to a child module. Import it without -import-blocks instead.", addr),
+			Subject:  imp.DefRange.Ptr(),
+		})
+	}
+	return diags
+}
+
+// writeImportBlocks appends one import block for each of the given actions
+// to the given file, creating it if necessary.
+func writeImportBlocks(filename string, actions []*importPlanState) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	var oldSrc []byte
+	if src, err := ioutil.ReadFile(filename); err == nil {
+		oldSrc = src
+	}
+
+	f, moreDiags := hclwrite.ParseConfig(oldSrc, filename, hcl.InitialPos)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return diags
+	}
+
+	body := f.Body()
+	for _, action := range actions {
+		if len(body.Blocks()) != 0 || len(body.Attributes()) != 0 {
+			body.AppendNewline()
+		}
+		block := body.AppendNewBlock("import", nil)
+		block.Body().SetAttributeTraversal("to", action.Target.Traversal())
+		block.Body().SetAttributeValue("id", cty.StringVal(action.ID))
+	}
+
+	err := ioutil.WriteFile(filename, f.Bytes(), 0644)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to write import blocks",
+			Detail:   fmt.Sprintf("Could not update %s with new import blocks: %s.", filename, err),
+		})
+	}
+	return diags
+}
@@ -0,0 +1,90 @@
+package terrafy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// addImportRules adds the rules from the ignore_attributes, only_attributes,
+// and override arguments of an import block to the options.
+func (o *genOptions) addImportRules(ignore, only []string, overrides map[string]string) {
+	for _, path := range ignore {
+		o.SkipArguments[path] = true
+	}
+	if len(only) != 0 {
+		o.OnlyArguments = make(map[string]bool, len(only)+len(overrides))
+		for _, path := range only {
+			o.OnlyArguments[path] = true
+		}
+		// We'll need to generate any nested blocks containing overrides,
+		// even if they weren't listed.
+		for path := range overrides {
+			o.OnlyArguments[path] = true
+		}
+	}
+	if len(overrides) != 0 {
+		o.Overrides = make(map[string]string, len(overrides))
+		for path, src := range overrides {
+			o.Overrides[path] = src
+		}
+		o.usedOverrides = map[string]bool{}
+	}
+}
+
+// included returns true if the argument or nested block with the given path
+// is allowed by OnlyArguments: if it's listed itself, if it belongs to a
+// nested block that is listed, or if it's a nested block containing
+// something that is listed.
+func (o *genOptions) included(path string) bool {
+	if o.OnlyArguments == nil {
+		return true
+	}
+	for only := range o.OnlyArguments {
+		if only == path || strings.HasPrefix(path, only+".") || strings.HasPrefix(only, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideTokens returns the tokens of the override expression for the
+// argument with the given path, or false if there isn't one.
+func (o *genOptions) overrideTokens(path string) (hclwrite.Tokens, bool) {
+	src, exists := o.Overrides[path]
+	if !exists {
+		return nil, false
+	}
+	f, diags := hclwrite.ParseConfig([]byte("v = "+src+"\n"), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		// Should never happen, because we parsed this same source code as
+		// part of its .tfy file.
+		return nil, false
+	}
+	o.usedOverrides[path] = true
+	return f.Body().GetAttribute("v").Expr().BuildTokens(nil), true
+}
+
+// unusedOverrides returns warnings about any overrides that didn't match an
+// argument that Terrafy generated, which are probably mistakes.
+func (o *genOptions) unusedOverrides(addr resourceAddr) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	var unused []string
+	for path := range o.Overrides {
+		if !o.usedOverrides[path] {
+			unused = append(unused, path)
+		}
+	}
+	sort.Strings(unused)
+	for _, path := range unused {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Unused override",
+			Detail:   fmt.Sprintf("The import configuration for %s overrides %s, but Terrafy didn't generate that argument. Check that it's an argument of resource type %q, and that any nested block containing it exists in the imported objects.", addr, path, addr.Type),
+		})
+	}
+	return diags
+}
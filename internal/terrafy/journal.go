@@ -0,0 +1,253 @@
+package terrafy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// journalFile is the name of the file where Terrafy records its progress
+// while applying, so that "terrafy apply -resume" can continue an apply
+// that failed partway through. Like stateBackupFile it lives in the
+// .terraform directory, because it's working data for this directory only.
+var journalFile = filepath.Join(".terraform", "terrafy-journal.json")
+
+// journalEntry is a single line of the journal file. The first line records
+// the whole plan, and then each subsequent line records one completed step.
+type journalEntry struct {
+	Plan      *planFile         `json:"plan,omitempty"`
+	Imported  *planFileState    `json:"imported,omitempty"`
+	Generated *planFileResource `json:"generated,omitempty"`
+}
+
+// journalProgress describes the steps of a journaled plan that are already
+// complete.
+type journalProgress struct {
+	Imported  map[string]bool // instance address strings
+	Generated map[resourceAddr]bool
+}
+
+// importJournal appends entries to the journal file as applyImporting
+// completes each step. A nil *importJournal is valid and records nothing,
+// for when we're generating import blocks and so there's nothing to resume.
+type importJournal struct {
+	filename string
+	f        *os.File
+}
+
+func journalFilename(opts *Options) string {
+	return filepath.Join(opts.dir(), journalFile)
+}
+
+// checkNoJournal returns an error diagnostic if there's a journal left
+// behind by an earlier apply that didn't complete, because starting a new
+// apply would lose track of it.
+func checkNoJournal(opts *Options) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	filename := journalFilename(opts)
+	if _, err := os.Stat(filename); err == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Unfinished apply",
+			Detail:   fmt.Sprintf("An earlier apply in this directory didn't complete, and recorded its progress in %s.\n\nTo continue it, run:\n    terrafy apply -resume\n\nTo abandon it and start a new plan instead, delete %s and try again.", filename, journalFile),
+		})
+	}
+	return diags
+}
+
+// startImportJournal creates a new journal file for the given plan. The
+// result is nil if the plan is for generating import blocks.
+func startImportJournal(opts *Options, plan *importPlan) (*importJournal, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if plan.ImportBlocksFile != "" {
+		return nil, diags
+	}
+
+	filename := journalFilename(opts)
+	pf, err := newPlanFile(plan, opts.dir())
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.Create(filename)
+		if err == nil {
+			j := &importJournal{filename: filename, f: f}
+			err = j.write(journalEntry{Plan: pf})
+			if err == nil {
+				return j, diags
+			}
+			j.close()
+		}
+	}
+	diags = diags.Append(&hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Failed to create journal",
+		Detail:   fmt.Sprintf("Could not create %s to record progress: %s.", filename, err),
+	})
+	return nil, diags
+}
+
+// resumeImportJournal opens the existing journal file to record the further
+// progress of an apply that we're resuming.
+func resumeImportJournal(opts *Options) (*importJournal, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	filename := journalFilename(opts)
+	src, err := ioutil.ReadFile(filename)
+	if err == nil {
+		// We discard any incomplete final line, as readImportJournal does,
+		// so that our new entries will start on a line of their own.
+		err = os.Truncate(filename, int64(bytes.LastIndexByte(src, '\n')+1))
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	}
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to open journal",
+			Detail:   fmt.Sprintf("Could not open %s to record progress: %s.", filename, err),
+		})
+		return nil, diags
+	}
+	return &importJournal{filename: filename, f: f}, diags
+}
+
+// readImportJournal reads the plan recorded in the given journal file, along
+// with the steps that are already complete, resolving the target filenames
+// relative to dir.
+func readImportJournal(filename string, dir string) (*importPlan, *journalProgress, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var plan *importPlan
+	progress := &journalProgress{
+		Imported:  map[string]bool{},
+		Generated: map[resourceAddr]bool{},
+	}
+	lines := bytes.Split(src, []byte{'\n'})
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				// An incomplete final line means that Terrafy was interrupted
+				// while writing it, so that step didn't finish.
+				break
+			}
+			return nil, nil, fmt.Errorf("invalid entry on line %d: %s", i+1, err)
+		}
+		switch {
+		case entry.Plan != nil:
+			if plan != nil {
+				return nil, nil, fmt.Errorf("unexpected plan on line %d", i+1)
+			}
+			plan, err = entry.Plan.plan(dir)
+			if err != nil {
+				return nil, nil, err
+			}
+		case plan == nil:
+			return nil, nil, fmt.Errorf("missing plan on line %d", i+1)
+		case entry.Imported != nil:
+			addr, err := entry.Imported.addr()
+			if err != nil {
+				return nil, nil, err
+			}
+			progress.Imported[addr.String()] = true
+		case entry.Generated != nil:
+			addr, err := entry.Generated.addr()
+			if err != nil {
+				return nil, nil, err
+			}
+			progress.Generated[addr] = true
+		}
+	}
+	if plan == nil {
+		return nil, nil, fmt.Errorf("no plan recorded")
+	}
+	return plan, progress, nil
+}
+
+// recordImport records that the given instance is now in the state.
+func (j *importJournal) recordImport(action *importPlanState) hcl.Diagnostics {
+	return j.record(journalEntry{
+		Imported: &planFileState{
+			Resource: newPlanFileResource(action.Target.Resource),
+			Key:      action.Target.InstanceKey,
+			ID:       action.ID,
+		},
+	})
+}
+
+// recordGenerated records that the given resource now has configuration.
+func (j *importJournal) recordGenerated(action *importPlanConfig) hcl.Diagnostics {
+	r := newPlanFileResource(action.Target)
+	return j.record(journalEntry{Generated: &r})
+}
+
+func (j *importJournal) record(entry journalEntry) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if j == nil {
+		return diags
+	}
+	if err := j.write(entry); err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to update journal",
+			Detail:   fmt.Sprintf("Could not record progress in %s: %s.", j.filename, err),
+		})
+	}
+	return diags
+}
+
+func (j *importJournal) write(entry journalEntry) error {
+	src, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	src = append(src, '\n')
+	if _, err := j.f.Write(src); err != nil {
+		return err
+	}
+	// We sync after every entry because the journal is only useful if it
+	// survives whatever interrupted the apply.
+	return j.f.Sync()
+}
+
+// close closes the journal file, leaving it in place so that a later apply
+// can resume from it.
+func (j *importJournal) close() {
+	if j == nil || j.f == nil {
+		return
+	}
+	j.f.Close()
+	j.f = nil
+}
+
+// remove closes and deletes the journal file, once there's nothing left
+// to resume.
+func (j *importJournal) remove() hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if j == nil {
+		return diags
+	}
+	j.close()
+	if err := os.Remove(j.filename); err != nil && !os.IsNotExist(err) {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Failed to remove journal",
+			Detail:   fmt.Sprintf("Could not remove %s: %s. Delete this file before running Terrafy again in this directory.", j.filename, err),
+		})
+	}
+	return diags
+}
@@ -0,0 +1,165 @@
+package terrafy
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+const (
+	journalTestPlan      = `{"plan":{"format_version":1,"sources_fingerprint":"abc","state_serial":1,"ids":{},"to_state":[{"resource":{"mode":"managed","type":"test_thing","name":"a"},"key":0,"id":"i-0"},{"resource":{"mode":"managed","type":"test_thing","name":"a"},"key":1,"id":"i-1"}],"to_config":[{"resource":{"mode":"managed","type":"test_thing","name":"a"},"repeat_mode":"count","filename":"main.tf"}]}}`
+	journalTestImported0 = `{"imported":{"resource":{"mode":"managed","type":"test_thing","name":"a"},"key":0,"id":"i-0"}}`
+	journalTestImported1 = `{"imported":{"resource":{"mode":"managed","type":"test_thing","name":"a"},"key":1,"id":"i-1"}}`
+	journalTestGenerated = `{"generated":{"mode":"managed","type":"test_thing","name":"a"}}`
+)
+
+func TestReadImportJournal(t *testing.T) {
+	tests := map[string]struct {
+		src           string
+		wantImported  []string
+		wantGenerated []string
+		wantErr       string
+	}{
+		"plan only": {
+			src: journalTestPlan + "\n",
+		},
+		"progress": {
+			src:           journalTestPlan + "\n" + journalTestImported0 + "\n" + journalTestImported1 + "\n" + journalTestGenerated + "\n",
+			wantImported:  []string{"test_thing.a[0]", "test_thing.a[1]"},
+			wantGenerated: []string{"test_thing.a"},
+		},
+		"truncated last line": {
+			src:          journalTestPlan + "\n" + journalTestImported0 + "\n" + journalTestImported1[:20],
+			wantImported: []string{"test_thing.a[0]"},
+		},
+		"blank lines": {
+			src:          "\n" + journalTestPlan + "\n\n" + journalTestImported0 + "\n\n",
+			wantImported: []string{"test_thing.a[0]"},
+		},
+		"invalid line before the last": {
+			src:     journalTestPlan + "\n" + journalTestImported1[:20] + "\n" + journalTestImported0 + "\n",
+			wantErr: "invalid entry on line 2",
+		},
+		"truncated line followed by a newline": {
+			// The newline is only written along with a complete entry,
+			// so this isn't the result of an interrupted write.
+			src:     journalTestPlan + "\n" + journalTestImported0[:20] + "\n",
+			wantErr: "invalid entry on line 2",
+		},
+		"missing plan": {
+			src:     journalTestImported0 + "\n" + journalTestPlan + "\n",
+			wantErr: "missing plan on line 1",
+		},
+		"second plan": {
+			src:     journalTestPlan + "\n" + journalTestPlan + "\n",
+			wantErr: "unexpected plan on line 2",
+		},
+		"empty": {
+			src:     "",
+			wantErr: "no plan recorded",
+		},
+		"truncated plan": {
+			src:     journalTestPlan[:30],
+			wantErr: "no plan recorded",
+		},
+		"invalid resource": {
+			src:     journalTestPlan + "\n" + `{"generated":{"mode":"bogus","type":"test_thing","name":"a"}}` + "\n",
+			wantErr: `invalid resource mode "bogus"`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, journalFile)
+			writeTestFile(t, filename, test.src)
+
+			plan, progress, err := readImportJournal(filename, dir)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("unexpected success; want error %q", test.wantErr)
+				}
+				if !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got, want := len(plan.ToState), 2; got != want {
+				t.Errorf("wrong number of instances to import %d; want %d", got, want)
+			}
+			if got, want := len(plan.ToConfig), 1; got != want {
+				t.Fatalf("wrong number of resources to generate %d; want %d", got, want)
+			}
+			if got, want := plan.ToConfig[0].Filename, filepath.Join(dir, "main.tf"); got != want {
+				t.Errorf("wrong target filename %s; want %s", got, want)
+			}
+
+			wantImported := map[string]bool{}
+			for _, addr := range test.wantImported {
+				wantImported[addr] = true
+			}
+			if !reflect.DeepEqual(progress.Imported, wantImported) {
+				t.Errorf("wrong imported instances\ngot:  %#v\nwant: %#v", progress.Imported, wantImported)
+			}
+			gotGenerated := map[string]bool{}
+			for addr := range progress.Generated {
+				gotGenerated[addr.String()] = true
+			}
+			wantGenerated := map[string]bool{}
+			for _, addr := range test.wantGenerated {
+				wantGenerated[addr] = true
+			}
+			if !reflect.DeepEqual(gotGenerated, wantGenerated) {
+				t.Errorf("wrong generated resources\ngot:  %#v\nwant: %#v", gotGenerated, wantGenerated)
+			}
+		})
+	}
+}
+
+func TestResumeImportJournal(t *testing.T) {
+	// Resuming must discard a truncated last line, so that the entries
+	// we add afterwards can still be read.
+	dir := t.TempDir()
+	filename := filepath.Join(dir, journalFile)
+	src := journalTestPlan + "\n" + journalTestImported0 + "\n" + journalTestImported1[:20]
+	writeTestFile(t, filename, src)
+
+	jnl, diags := resumeImportJournal(&Options{Dir: dir})
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	diags = jnl.recordImport(&importPlanState{
+		Target: resourceInstanceAddr{
+			Resource: resourceAddr{
+				Mode: tfjson.ManagedResourceMode,
+				Type: "test_thing",
+				Name: "a",
+			},
+			InstanceKey: 1,
+		},
+		ID: "i-1",
+	})
+	jnl.close()
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+
+	_, progress, err := readImportJournal(filename, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]bool{
+		"test_thing.a[0]": true,
+		"test_thing.a[1]": true,
+	}
+	if !reflect.DeepEqual(progress.Imported, want) {
+		t.Errorf("wrong imported instances\ngot:  %#v\nwant: %#v", progress.Imported, want)
+	}
+}
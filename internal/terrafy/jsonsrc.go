@@ -0,0 +1,176 @@
+package terrafy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// prepJSONIDsOutput is the name of the output value in the temporary
+// configuration that collects the ids of any imports declared in JSON
+// syntax, which can't be included in the main "ids" output.
+const prepJSONIDsOutput = "json_ids"
+
+// jsonBlockBody is the raw source code of the body of a block found in a
+// file written in HCL's JSON syntax.
+type jsonBlockBody struct {
+	Labels []string
+	Raw    json.RawMessage
+
+	// Filename and Start are the file that Raw came from and its byte
+	// offset within that file.
+	Filename string
+	Start    int
+}
+
+// findJSONBlockBodies finds the raw source code of the bodies of all of the
+// top-level blocks of the given type in the given JSON source code.
+//
+// HCL's JSON syntax allows several different shapes for the same blocks,
+// using either objects or arrays of objects at each level of labels, so
+// this tolerates all of them and returns a flat list of bodies.
+func findJSONBlockBodies(file *hcl.File, filename, blockType string, labelCount int) ([]jsonBlockBody, error) {
+	var ret []jsonBlockBody
+	err := walkJSONObjects(file.Bytes, 0, func(key string, raw json.RawMessage, start int) error {
+		if key != blockType {
+			return nil
+		}
+		return collectJSONBlockBodies(raw, start, nil, labelCount, &ret)
+	})
+	for i := range ret {
+		ret[i].Filename = filename
+	}
+	return ret, err
+}
+
+// findJSONBlockBody finds the raw body of the given block, which must have
+// been declared in JSON syntax. It returns false if it cannot find the block
+// in the source code.
+//
+// If there are several blocks with the same type and labels, as can be true
+// for provider configurations, the given function selects which one to use.
+// It may be nil if the labels are unique.
+func findJSONBlockBody(files map[string]*hcl.File, block *hcl.Block, match func(raw json.RawMessage) bool) (jsonBlockBody, bool) {
+	filename := block.DefRange.Filename
+	file := files[filename]
+	if file == nil {
+		return jsonBlockBody{}, false
+	}
+	bodies, err := findJSONBlockBodies(file, filename, block.Type, len(block.Labels))
+	if err != nil {
+		return jsonBlockBody{}, false
+	}
+Bodies:
+	for _, body := range bodies {
+		for i, label := range block.Labels {
+			if body.Labels[i] != label {
+				continue Bodies
+			}
+		}
+		if match == nil || match(body.Raw) {
+			return body, true
+		}
+	}
+	return jsonBlockBody{}, false
+}
+
+// findJSONProviderBody is a specialization of findJSONBlockBody for provider
+// configuration blocks, which are distinguished by their alias rather than
+// by their labels alone.
+func findJSONProviderBody(files map[string]*hcl.File, block *hcl.Block, alias string) (jsonBlockBody, bool) {
+	return findJSONBlockBody(files, block, func(raw json.RawMessage) bool {
+		var meta struct {
+			Alias string `json:"alias"`
+		}
+		// If the alias isn't a string then we'll just treat it as absent.
+		json.Unmarshal(raw, &meta)
+		return meta.Alias == alias
+	})
+}
+
+// jsonString returns the given string as a quoted JSON string.
+func jsonString(s string) string {
+	src, _ := json.Marshal(s)
+	return string(src)
+}
+
+func collectJSONBlockBodies(raw json.RawMessage, start int, labels []string, remaining int, into *[]jsonBlockBody) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("missing value at byte %d", start)
+	}
+
+	switch raw[0] {
+	case '[':
+		// An array of objects is just a way to write several
+		// objects at the same level, so we'll visit each one in turn.
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for dec.More() {
+			var elem json.RawMessage
+			if err := dec.Decode(&elem); err != nil {
+				return err
+			}
+			elemStart := start + int(dec.InputOffset()) - len(elem)
+			if err := collectJSONBlockBodies(elem, elemStart, labels, remaining, into); err != nil {
+				return err
+			}
+		}
+		return nil
+	case '{':
+		if remaining == 0 {
+			*into = append(*into, jsonBlockBody{
+				Labels: labels,
+				Raw:    raw,
+				Start:  start,
+			})
+			return nil
+		}
+		return walkJSONObjects(raw, start, func(key string, raw json.RawMessage, start int) error {
+			// We must copy the labels here because otherwise our appends
+			// could clobber the labels of a sibling block.
+			childLabels := make([]string, len(labels), len(labels)+1)
+			copy(childLabels, labels)
+			childLabels = append(childLabels, key)
+			return collectJSONBlockBodies(raw, start, childLabels, remaining-1, into)
+		})
+	default:
+		return fmt.Errorf("expected a JSON object or array at byte %d", start)
+	}
+}
+
+// walkJSONObjects calls the given function for each property of the JSON
+// object in the given source, passing the raw value of each property along
+// with its byte offset, which is relative to the given base offset.
+func walkJSONObjects(src []byte, base int, fn func(key string, raw json.RawMessage, start int) error) error {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected a JSON object at byte %d", base)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("expected a JSON property name at byte %d", base+int(dec.InputOffset()))
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		start := base + int(dec.InputOffset()) - len(raw)
+		if err := fn(key, raw, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package terrafy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// The available values for Settings.ForEachStyle.
+const (
+	// forEachStyleToset generates for_each over a set of the instance keys,
+	// with lookup tables for any arguments whose values differ between
+	// the instances.
+	forEachStyleToset = "toset"
+
+	// forEachStyleLocals generates for_each over a local value that maps
+	// each instance key to an object of the values that differ between the
+	// instances, which the arguments then refer to through each.value.
+	forEachStyleLocals = "locals"
+)
+
+// addLocalValues records the given per-instance values of the argument with
+// the given path in o.LocalValues, returning false if that isn't possible
+// because the instances don't have string keys.
+func (o *genOptions) addLocalValues(path string, vals map[resourceInstanceAddr]cty.Value) bool {
+	for instAddr := range vals {
+		if _, ok := instAddr.InstanceKey.(string); !ok {
+			return false
+		}
+	}
+	attr := o.localValueAttr(path)
+	for instAddr, v := range vals {
+		key := instAddr.InstanceKey.(string)
+		if o.LocalValues[key] == nil {
+			o.LocalValues[key] = map[string]cty.Value{}
+		}
+		o.LocalValues[key][attr] = v
+	}
+	return true
+}
+
+// localValueAttr returns the name of the attribute in the objects of the
+// local value that will hold the value of the argument with the given value
+// path, which is unique to that path.
+func (o *genOptions) localValueAttr(path string) string {
+	if name, exists := o.localAttrs[path]; exists {
+		return name
+	}
+	if o.localAttrs == nil {
+		o.localAttrs = map[string]string{}
+		o.localNames = map[string]bool{}
+	}
+
+	// Paths like ingress["0"].from_port become ingress_0_from_port, but
+	// that can make different paths look the same, such as a.b and a_b, and
+	// so we add a suffix to any later duplicates.
+	base := strings.Trim(nonIdentifierChars.ReplaceAllString(path, "_"), "_")
+	name := base
+	for i := 2; o.localNames[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	o.localAttrs[path] = name
+	o.localNames[name] = true
+	return name
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// localValueName returns a name for the local value that a resource with the
+// given address will use for for_each, which doesn't conflict with any
+// of the local values already declared in the module in the given directory.
+func localValueName(addr resourceAddr, dir string) string {
+	existing := map[string]bool{}
+	for _, block := range moduleBlocks(dir, localsDeclsSchema) {
+		attrs, _ := block.Body.JustAttributes()
+		for name := range attrs {
+			existing[name] = true
+		}
+	}
+
+	base := fmt.Sprintf("%s_%s", addr.Type, addr.Name)
+	name := base
+	for i := 2; existing[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	return name
+}
+
+var localsDeclsSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "locals"},
+	},
+}
+
+// appendLocalsBlock appends a locals block declaring a local value with the
+// given name, whose value is a map from instance key to an object of the
+// given values for that instance.
+func appendLocalsBlock(body *hclwrite.Body, name string, vals map[string]map[string]cty.Value) {
+	objs := make(map[string]cty.Value, len(vals))
+	for key, attrs := range vals {
+		objs[key] = cty.ObjectVal(attrs)
+	}
+	block := body.AppendNewBlock("locals", nil)
+	block.Body().SetAttributeValue(name, cty.ObjectVal(objs))
+}
+
+// localValueTraversal returns the traversal that refers to the local value
+// with the given name.
+func localValueTraversal(name string) hcl.Traversal {
+	return hcl.Traversal{
+		hcl.TraverseRoot{Name: "local"},
+		hcl.TraverseAttr{Name: name},
+	}
+}
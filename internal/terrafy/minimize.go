@@ -0,0 +1,246 @@
+package terrafy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// checkMinimizeSupport returns error diagnostics if it won't be possible to
+// minimize the configuration generated for the given plan.
+func checkMinimizeSupport(plan *importPlan, tf *tfexec.Terraform) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	if plan.ImportBlocksFile != "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Cannot minimize in import blocks mode",
+			Detail:   "Minimizing the generated configuration requires the objects to already be imported into the Terraform state, so it isn't possible when generating import blocks.",
+		})
+		return diags
+	}
+	for _, action := range plan.ToConfig {
+		if isJSONConfigFile(action.Filename) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Cannot minimize JSON configuration",
+				Detail:   fmt.Sprintf("Terrafy can only minimize configuration generated in the native syntax, but the configuration for %s will be generated in %s.", action.Target, action.Filename),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+
+	// "terraform plan -json" was introduced in Terraform v0.15.3.
+	ok, tfVersion, err := terraformVersionAtLeast(tf, 0, 15, 3)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to determine Terraform version",
+			Detail:   fmt.Sprintf("Could not determine whether the Terraform CLI supports machine-readable plans: %s.", err),
+		})
+		return diags
+	}
+	if !ok {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Terraform version does not support minimizing",
+			Detail:   fmt.Sprintf("Minimizing the generated configuration requires Terraform v0.15.3 or later, but the selected Terraform CLI is v%s.", tfVersion),
+		})
+	}
+	return diags
+}
+
+// minimizeResourceConfig tries removing each of the optional arguments and
+// nested blocks from the resource block that was most recently generated
+// for the given action, keeping each removal only if Terraform still plans
+// no changes for the resource afterwards. It returns the names of the
+// arguments and block types it removed.
+//
+// This relies on the objects already being imported into the state of the
+// main working directory, so it isn't possible in import blocks mode.
+func minimizeResourceConfig(opts *Options, action *importPlanConfig, schema *tfjson.Schema) ([]string, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	// If the configuration we generated doesn't already produce an empty
+	// plan then we can't tell whether removing something made it worse.
+	clean, err := planIsClean(opts, action.Target)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to create plan",
+			Detail:   fmt.Sprintf("Could not create a Terraform plan to minimize the configuration for %s:\n\n%s", action.Target, err),
+		})
+		return nil, diags
+	}
+	if !clean {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Cannot minimize generated configuration",
+			Detail:   fmt.Sprintf("The generated configuration for %s doesn't match the imported objects exactly, so Terrafy can't determine which of its arguments are unnecessary. Review the generated configuration and then run \"terraform plan\" to see the differences.", action.Target),
+		})
+		return nil, diags
+	}
+
+	var candidates []string
+	for name, attrS := range schema.Block.Attributes {
+		if attrS.Optional && !attrS.Required {
+			candidates = append(candidates, name)
+		}
+	}
+	for typeName, blockS := range schema.Block.NestedBlocks {
+		if blockS.MinItems == 0 {
+			candidates = append(candidates, typeName)
+		}
+	}
+	sort.Strings(candidates)
+
+	// Whatever the generate and override blocks set is there because the
+	// user asked for it, and so isn't ours to remove.
+	fromTemplate := templateNames(action.Template)
+	for path := range action.Overrides {
+		if !strings.Contains(path, ".") {
+			fromTemplate[path] = true
+		}
+	}
+
+	var removed []string
+	for _, name := range candidates {
+		if fromTemplate[name] {
+			continue
+		}
+		oldSrc, err := ioutil.ReadFile(action.Filename)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read configuration file",
+				Detail:   fmt.Sprintf("Could not read %s to minimize the configuration for %s: %s.", action.Filename, action.Target, err),
+			})
+			return removed, diags
+		}
+		f, moreDiags := hclwrite.ParseConfig(oldSrc, action.Filename, hcl.InitialPos)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return removed, diags
+		}
+
+		// The block we generated is always the last one in the file, because
+		// we only just appended it.
+		blocks := f.Body().Blocks()
+		if len(blocks) == 0 {
+			return removed, diags
+		}
+		body := blocks[len(blocks)-1].Body()
+		changed := false
+		if body.GetAttribute(name) != nil {
+			body.RemoveAttribute(name)
+			changed = true
+		}
+		for _, nested := range body.Blocks() {
+			if nested.Type() == name {
+				body.RemoveBlock(nested)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		err = ioutil.WriteFile(action.Filename, f.Bytes(), 0644)
+		if err == nil {
+			clean, err = planIsClean(opts, action.Target)
+		}
+		if err != nil || !clean {
+			// We'll put back what we had before, whether this failed or
+			// just caused a difference.
+			if restoreErr := ioutil.WriteFile(action.Filename, oldSrc, 0644); restoreErr != nil {
+				err = restoreErr
+			}
+		}
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to minimize generated configuration",
+				Detail:   fmt.Sprintf("Error while testing whether %s is needed in the configuration for %s:\n\n%s", name, action.Target, err),
+			})
+			return removed, diags
+		}
+		if clean {
+			removed = append(removed, name)
+		}
+	}
+
+	return removed, diags
+}
+
+// planIsClean runs "terraform plan" in the main working directory, targeting
+// only the given resource, and returns true if it would make no changes to
+// that resource.
+//
+// It returns an error only if Terraform fails without explaining why. If
+// Terraform reports errors, such as if a required argument is missing, then
+// the plan is not clean but there is no error.
+func planIsClean(opts *Options, target resourceAddr) (bool, error) {
+	stdout, err := runTerraform(context.Background(), opts.TerraformExec, opts.dir(), nil,
+		"plan", "-json", "-input=false", "-lock=false", "-refresh=false", "-target="+target.String(),
+	)
+
+	type jsonMessage struct {
+		Type       string `json:"type"`
+		Diagnostic *struct {
+			Severity string `json:"severity"`
+		} `json:"diagnostic"`
+		Change *struct {
+			Resource struct {
+				Addr string `json:"addr"`
+			} `json:"resource"`
+			Action string `json:"action"`
+		} `json:"change"`
+	}
+
+	clean := true
+	reportedErrors := false
+	sc := bufio.NewScanner(bytes.NewReader(stdout))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var msg jsonMessage
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "diagnostic":
+			if msg.Diagnostic != nil && msg.Diagnostic.Severity == "error" {
+				clean = false
+				reportedErrors = true
+			}
+		case "planned_change":
+			if msg.Change == nil || msg.Change.Action == "noop" {
+				continue
+			}
+			traversal, diags := hclsyntax.ParseTraversalAbs([]byte(msg.Change.Resource.Addr), "", hcl.InitialPos)
+			if diags.HasErrors() {
+				continue
+			}
+			instAddr, ok := resourceInstanceAddrFromTraversal(traversal)
+			if ok && instAddr.Resource.ConfigAddr() == target {
+				clean = false
+			}
+		}
+	}
+	if err != nil && !reportedErrors {
+		return false, err
+	}
+	return clean, nil
+}
@@ -0,0 +1,382 @@
+package terrafy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// moduleInstanceStep is a single step in the address of a module instance,
+// such as the module.network["a"] in module.network["a"].module.subnet.
+type moduleInstanceStep struct {
+	Name        string
+	InstanceKey interface{}
+}
+
+// moduleInstanceString returns the Terraform-style address of the module
+// instance with the given steps, or an empty string for the root module.
+func moduleInstanceString(steps []moduleInstanceStep) string {
+	var buf strings.Builder
+	for i, step := range steps {
+		if i > 0 {
+			buf.WriteByte('.')
+		}
+		buf.WriteString("module.")
+		buf.WriteString(step.Name)
+		switch k := step.InstanceKey.(type) {
+		case string:
+			fmt.Fprintf(&buf, "[%q]", k)
+		case int:
+			fmt.Fprintf(&buf, "[%d]", k)
+		}
+	}
+	return buf.String()
+}
+
+// modulePathString is like moduleInstanceString but omits the instance keys,
+// producing the address of the module in the configuration rather than of
+// one of its instances.
+func modulePathString(steps []moduleInstanceStep) string {
+	pathSteps := make([]moduleInstanceStep, len(steps))
+	for i, step := range steps {
+		pathSteps[i] = moduleInstanceStep{Name: step.Name}
+	}
+	return moduleInstanceString(pathSteps)
+}
+
+// moduleStepsFromTraversal consumes any leading module steps from the given
+// traversal, returning them along with the rest of the traversal. It returns
+// false if the module steps are invalid.
+func moduleStepsFromTraversal(traversal hcl.Traversal) ([]moduleInstanceStep, hcl.Traversal, bool) {
+	var steps []moduleInstanceStep
+	for len(traversal) != 0 {
+		if name, ok := traversalStepName(traversal[0]); !ok || name != "module" {
+			break
+		}
+		if len(traversal) < 2 {
+			return nil, nil, false
+		}
+		name, ok := traversalStepName(traversal[1])
+		if !ok {
+			return nil, nil, false
+		}
+		step := moduleInstanceStep{Name: name}
+		traversal = traversal[2:]
+		if len(traversal) != 0 {
+			if idx, ok := traversal[0].(hcl.TraverseIndex); ok {
+				key, ok := instanceKeyFromValue(idx.Key)
+				if !ok {
+					return nil, nil, false
+				}
+				step.InstanceKey = key
+				traversal = traversal[1:]
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, traversal, true
+}
+
+// moduleStepsFromString parses a module instance address previously returned
+// by moduleInstanceString.
+func moduleStepsFromString(addr string) ([]moduleInstanceStep, bool) {
+	if addr == "" {
+		return nil, true
+	}
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(addr), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, false
+	}
+	steps, rest, ok := moduleStepsFromTraversal(traversal)
+	if !ok || len(rest) != 0 {
+		return nil, false
+	}
+	return steps, true
+}
+
+func traversalStepName(step hcl.Traverser) (string, bool) {
+	switch step := step.(type) {
+	case hcl.TraverseRoot:
+		return step.Name, true
+	case hcl.TraverseAttr:
+		return step.Name, true
+	default:
+		return "", false
+	}
+}
+
+// instanceKeyFromValue converts the given index key value into an instance
+// key, returning false if it isn't a valid instance key.
+func instanceKeyFromValue(v cty.Value) (interface{}, bool) {
+	if v.IsNull() || !v.IsKnown() {
+		return nil, false
+	}
+	switch v.Type() {
+	case cty.String:
+		return v.AsString(), true
+	case cty.Number:
+		bf := v.AsBigFloat()
+		i, acc := bf.Int64()
+		if acc != big.Exact {
+			return nil, false
+		}
+		return int(i), true
+	default:
+		return nil, false
+	}
+}
+
+// stateResource is a resource instance from a state snapshot, along with
+// the address of the module instance it belongs to.
+type stateResource struct {
+	Module string
+	*tfjson.StateResource
+}
+
+// InstanceAddr returns the address of the resource instance.
+func (rs stateResource) InstanceAddr() resourceInstanceAddr {
+	index := rs.Index
+	if f, ok := index.(float64); ok {
+		// The tfjson docs state that Index will be an int for
+		// instances created with "count", but in practice it seems
+		// to use float64, at least in some cases. Therefore we'll
+		// tolerate that here, but in a way that is resilient to
+		// the bug being fixed upstream later.
+		index = int(f)
+	}
+	return resourceInstanceAddr{
+		Resource: resourceAddr{
+			Module: rs.Module,
+			Mode:   rs.Mode,
+			Type:   rs.Type,
+			Name:   rs.Name,
+		},
+		InstanceKey: index,
+	}
+}
+
+// allStateResources returns all of the resource instances in the given state,
+// across all of its modules.
+func allStateResources(state *tfjson.State) []stateResource {
+	var ret []stateResource
+	if state == nil || state.Values == nil {
+		return ret
+	}
+	var visit func(mod *tfjson.StateModule)
+	visit = func(mod *tfjson.StateModule) {
+		if mod == nil {
+			return
+		}
+		for _, rs := range mod.Resources {
+			ret = append(ret, stateResource{
+				Module:        mod.Address,
+				StateResource: rs,
+			})
+		}
+		for _, child := range mod.ChildModules {
+			visit(child)
+		}
+	}
+	visit(state.Values.RootModule)
+	return ret
+}
+
+// moduleManifest is the subset of Terraform's record of installed modules,
+// in .terraform/modules/modules.json, that we use to find the source
+// directories of child modules.
+type moduleManifest struct {
+	Modules []struct {
+		Key string `json:"Key"`
+		Dir string `json:"Dir"`
+	} `json:"Modules"`
+}
+
+// readModuleManifest returns the directories of the modules that Terraform
+// has installed for the configuration in the given directory, keyed by the
+// dot-separated module call names that Terraform uses in its manifest. If
+// there's no manifest then the result is empty.
+func readModuleManifest(dir string) map[string]string {
+	ret := map[string]string{}
+	src, err := ioutil.ReadFile(filepath.Join(dir, ".terraform", "modules", "modules.json"))
+	if err != nil {
+		return ret
+	}
+	var manifest moduleManifest
+	if err := json.Unmarshal(src, &manifest); err != nil {
+		return ret
+	}
+	for _, mod := range manifest.Modules {
+		if mod.Key == "" {
+			continue // the root module
+		}
+		ret[mod.Key] = filepath.Join(dir, filepath.FromSlash(mod.Dir))
+	}
+	return ret
+}
+
+// loadChildModules finds the source directories of the given module calls
+// and records the managed resources declared in them, and then recursively
+// does the same for any module calls inside those modules.
+//
+// Module calls whose source we can't find are silently ignored, because
+// Terrafy only needs them if there are import blocks targeting them, and
+// LoadConfig will report that separately.
+//
+// callerRemote is the remote source address that the calling module came
+// from, if any, because local paths inside a remote module are also part of
+// the remote package.
+func loadChildModules(parser *hclparse.Parser, cfg *Config, manifest map[string]string, callerDir string, callerSteps []moduleInstanceStep, callerRemote string, calls map[string]string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	for name, source := range calls {
+		steps := make([]moduleInstanceStep, len(callerSteps), len(callerSteps)+1)
+		copy(steps, callerSteps)
+		steps = append(steps, moduleInstanceStep{Name: name})
+		path := modulePathString(steps)
+
+		keyParts := make([]string, len(steps))
+		for i, step := range steps {
+			keyParts[i] = step.Name
+		}
+		local := strings.HasPrefix(source, "./") || strings.HasPrefix(source, "../")
+		remote := callerRemote
+		if !local {
+			remote = source
+		}
+		moduleDir, installed := manifest[strings.Join(keyParts, ".")]
+		if !installed {
+			if !local {
+				continue
+			}
+			moduleDir = filepath.Join(callerDir, filepath.FromSlash(source))
+		}
+		cfg.ModuleDirs[path] = moduleDir
+		if remote != "" {
+			cfg.RemoteModules[path] = remote
+		}
+
+		tfFiles, _, err := findConfigFiles(moduleDir)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read module directory",
+				Detail:   fmt.Sprintf("Failed to read files in %s, for %s: %s.", moduleDir, path, err),
+			})
+			continue
+		}
+
+		childCalls := map[string]string{}
+		for _, fn := range tfFiles {
+			var file *hcl.File
+			var moreDiags hcl.Diagnostics
+			if strings.HasSuffix(fn, ".json") {
+				file, moreDiags = parser.ParseJSONFile(fn)
+			} else {
+				file, moreDiags = parser.ParseHCLFile(fn)
+			}
+			diags = append(diags, moreDiags...)
+			if file == nil {
+				continue
+			}
+
+			content, _, moreDiags := file.Body.PartialContent(childModuleSchema)
+			diags = append(diags, moreDiags...)
+			for _, block := range content.Blocks {
+				switch block.Type {
+				case "resource":
+					addr := resourceAddr{
+						Module: path,
+						Mode:   tfjson.ManagedResourceMode,
+						Type:   block.Labels[0],
+						Name:   block.Labels[1],
+					}
+					// Terraform itself will report any duplicates, so we'll
+					// just keep the first one here.
+					if _, exists := cfg.ManagedResources[addr]; !exists {
+						cfg.ManagedResources[addr] = block
+					}
+				case "module":
+					source, moreDiags := decodeModuleSource(block)
+					diags = append(diags, moreDiags...)
+					if source != "" {
+						childCalls[block.Labels[0]] = source
+					}
+				default:
+					panic("HCL produced a block type that wasn't in the schema")
+				}
+			}
+		}
+
+		moreDiags := loadChildModules(parser, cfg, manifest, moduleDir, steps, remote, childCalls)
+		diags = append(diags, moreDiags...)
+	}
+
+	return diags
+}
+
+// moduleBlocks returns the blocks of the types in the given schema from
+// all of the .tf and .tf.json files in the given module directory.
+//
+// This reads the files afresh, rather than using what LoadConfig found,
+// so that it includes any blocks that we've generated since. Any files that
+// we can't read or parse are skipped, because Terraform will report those
+// problems more clearly.
+func moduleBlocks(dir string, schema *hcl.BodySchema) []*hcl.Block {
+	var ret []*hcl.Block
+	tfFiles, _, err := findConfigFiles(dir)
+	if err != nil {
+		return ret
+	}
+	parser := hclparse.NewParser()
+	for _, fn := range tfFiles {
+		var file *hcl.File
+		if strings.HasSuffix(fn, ".json") {
+			file, _ = parser.ParseJSONFile(fn)
+		} else {
+			file, _ = parser.ParseHCLFile(fn)
+		}
+		if file == nil {
+			continue
+		}
+		content, _, _ := file.Body.PartialContent(schema)
+		ret = append(ret, content.Blocks...)
+	}
+	return ret
+}
+
+// decodeModuleSource returns the source address from the given module block,
+// or an empty string if it doesn't have a valid one.
+func decodeModuleSource(block *hcl.Block) (string, hcl.Diagnostics) {
+	content, _, diags := block.Body.PartialContent(moduleBlockSchema)
+	attr, exists := content.Attributes["source"]
+	if !exists {
+		return "", diags
+	}
+	var source string
+	moreDiags := gohcl.DecodeExpression(attr.Expr, nil, &source)
+	diags = append(diags, moreDiags...)
+	return source, diags
+}
+
+var childModuleSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "resource", LabelNames: []string{"type", "name"}},
+		{Type: "module", LabelNames: []string{"name"}},
+	},
+}
+
+var moduleBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "source"},
+	},
+}
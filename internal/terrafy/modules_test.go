@@ -0,0 +1,252 @@
+package terrafy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+func TestModuleStepsFromString(t *testing.T) {
+	tests := map[string]struct {
+		want    []moduleInstanceStep
+		wantErr bool
+	}{
+		"": {
+			want: nil,
+		},
+		"module.a": {
+			want: []moduleInstanceStep{{Name: "a"}},
+		},
+		"module.a[0]": {
+			want: []moduleInstanceStep{{Name: "a", InstanceKey: 0}},
+		},
+		`module.a["x"].module.b`: {
+			want: []moduleInstanceStep{{Name: "a", InstanceKey: "x"}, {Name: "b"}},
+		},
+		`module.a[2].module.b["y.z"]`: {
+			want: []moduleInstanceStep{{Name: "a", InstanceKey: 2}, {Name: "b", InstanceKey: "y.z"}},
+		},
+		"module": {
+			wantErr: true,
+		},
+		"module.a.b": {
+			wantErr: true,
+		},
+		"module.a[1.5]": {
+			wantErr: true,
+		},
+		"module.a[true]": {
+			wantErr: true,
+		},
+		"test_thing.a": {
+			wantErr: true,
+		},
+		"module.a[": {
+			wantErr: true,
+		},
+	}
+
+	for addr, test := range tests {
+		t.Run(addr, func(t *testing.T) {
+			got, ok := moduleStepsFromString(addr)
+			if test.wantErr {
+				if ok {
+					t.Fatalf("unexpected success: %#v", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("unexpected failure")
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("wrong steps\ngot:  %#v\nwant: %#v", got, test.want)
+			}
+			if roundTrip := moduleInstanceString(got); roundTrip != addr {
+				t.Fatalf("wrong round trip result %q", roundTrip)
+			}
+		})
+	}
+}
+
+func TestModuleStepsFromTraversal(t *testing.T) {
+	tests := map[string]struct {
+		wantSteps []moduleInstanceStep
+		wantRest  string
+	}{
+		"test_thing.a": {
+			wantSteps: nil,
+			wantRest:  "test_thing.a",
+		},
+		"module.a.test_thing.b[0]": {
+			wantSteps: []moduleInstanceStep{{Name: "a"}},
+			wantRest:  "test_thing.b[0]",
+		},
+		`module.a["x"].module.b[1].test_thing.c`: {
+			wantSteps: []moduleInstanceStep{{Name: "a", InstanceKey: "x"}, {Name: "b", InstanceKey: 1}},
+			wantRest:  "test_thing.c",
+		},
+	}
+
+	for addr, test := range tests {
+		t.Run(addr, func(t *testing.T) {
+			traversal, diags := hclsyntax.ParseTraversalAbs([]byte(addr), "", hcl.InitialPos)
+			if diags.HasErrors() {
+				t.Fatalf("invalid address: %s", diags.Error())
+			}
+			steps, rest, ok := moduleStepsFromTraversal(traversal)
+			if !ok {
+				t.Fatal("unexpected failure")
+			}
+			if !reflect.DeepEqual(steps, test.wantSteps) {
+				t.Errorf("wrong steps\ngot:  %#v\nwant: %#v", steps, test.wantSteps)
+			}
+			// The range of an attribute step includes its leading period.
+			restStart := len(addr)
+			if len(rest) != 0 {
+				restStart = rest.SourceRange().Start.Byte
+			}
+			if got := strings.TrimPrefix(addr[restStart:], "."); got != test.wantRest {
+				t.Errorf("wrong rest %q; want %q", got, test.wantRest)
+			}
+		})
+	}
+}
+
+func TestReadModuleManifest(t *testing.T) {
+	tests := map[string]struct {
+		manifest string // no manifest is created if empty
+		want     map[string]string
+	}{
+		"no manifest": {
+			want: map[string]string{},
+		},
+		"malformed manifest": {
+			manifest: `{"Modules":`,
+			want:     map[string]string{},
+		},
+		"wrong type": {
+			manifest: `{"Modules":{}}`,
+			want:     map[string]string{},
+		},
+		"modules": {
+			manifest: `{"Modules":[{"Key":"","Source":"","Dir":"."},{"Key":"net","Source":"example/net/aws","Dir":".terraform/modules/net"},{"Key":"net.sub","Source":"./sub","Dir":".terraform/modules/net/sub"}]}`,
+			want: map[string]string{
+				"net":     filepath.Join(".terraform", "modules", "net"),
+				"net.sub": filepath.Join(".terraform", "modules", "net", "sub"),
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.manifest != "" {
+				writeTestFile(t, filepath.Join(dir, ".terraform", "modules", "modules.json"), test.manifest)
+			}
+			got := readModuleManifest(dir)
+			want := make(map[string]string, len(test.want))
+			for k, v := range test.want {
+				want[k] = filepath.Join(dir, v)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("wrong result\ngot:  %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadChildModules(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "mods", "local", "main.tf"), `
+resource "test_thing" "a" {}
+
+module "inner" {
+  source = "./inner"
+}
+`)
+	writeTestFile(t, filepath.Join(dir, "mods", "local", "inner", "main.tf"), `
+resource "test_thing" "b" {}
+`)
+	writeTestFile(t, filepath.Join(dir, ".terraform", "modules", "remote", "main.tf"), `
+resource "test_thing" "c" {}
+
+module "sub" {
+  source = "./sub"
+}
+`)
+	writeTestFile(t, filepath.Join(dir, ".terraform", "modules", "remote", "sub", "main.tf"), `
+resource "test_thing" "d" {}
+`)
+	manifest := map[string]string{
+		"remote":     filepath.Join(dir, ".terraform", "modules", "remote"),
+		"remote.sub": filepath.Join(dir, ".terraform", "modules", "remote", "sub"),
+	}
+
+	cfg := &Config{
+		ManagedResources: map[resourceAddr]*hcl.Block{},
+		ModuleDirs:       map[string]string{},
+		RemoteModules:    map[string]string{},
+	}
+	diags := loadChildModules(hclparse.NewParser(), cfg, manifest, dir, nil, "", map[string]string{
+		"local":  "./mods/local",
+		"remote": "example/remote/aws",
+		// A remote module that isn't installed is ignored.
+		"missing": "example/missing/aws",
+	})
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+
+	wantDirs := map[string]string{
+		"module.local":              filepath.Join(dir, "mods", "local"),
+		"module.local.module.inner": filepath.Join(dir, "mods", "local", "inner"),
+		"module.remote":             manifest["remote"],
+		"module.remote.module.sub":  manifest["remote.sub"],
+	}
+	if !reflect.DeepEqual(cfg.ModuleDirs, wantDirs) {
+		t.Errorf("wrong module directories\ngot:  %#v\nwant: %#v", cfg.ModuleDirs, wantDirs)
+	}
+
+	// A local module inside a remote module is part of the same remote
+	// package.
+	wantRemote := map[string]string{
+		"module.remote":            "example/remote/aws",
+		"module.remote.module.sub": "example/remote/aws",
+	}
+	if !reflect.DeepEqual(cfg.RemoteModules, wantRemote) {
+		t.Errorf("wrong remote modules\ngot:  %#v\nwant: %#v", cfg.RemoteModules, wantRemote)
+	}
+
+	var gotResources []string
+	for addr := range cfg.ManagedResources {
+		gotResources = append(gotResources, addr.String())
+	}
+	sort.Strings(gotResources)
+	wantResources := []string{
+		"module.local.module.inner.test_thing.b",
+		"module.local.test_thing.a",
+		"module.remote.module.sub.test_thing.d",
+		"module.remote.test_thing.c",
+	}
+	if !reflect.DeepEqual(gotResources, wantResources) {
+		t.Errorf("wrong resources\ngot:  %#v\nwant: %#v", gotResources, wantResources)
+	}
+}
+
+func writeTestFile(t *testing.T, filename string, src string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
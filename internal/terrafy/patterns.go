@@ -0,0 +1,254 @@
+package terrafy
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// inferPatternTokens tries to find an expression in terms of count.index or
+// each.key that produces the given values, for when the values differ between
+// instances in a systematic way, such as "web-${each.key}" or
+// count.index + 1. It returns false if there is no such expression.
+//
+// This is a heuristic that only recognizes a few common patterns, so callers
+// must be prepared to generate something less idiomatic if it fails.
+func inferPatternTokens(vals map[resourceInstanceAddr]cty.Value) (hclwrite.Tokens, bool) {
+	if len(vals) < 2 {
+		return nil, false
+	}
+	var ty cty.Type
+	for _, v := range vals {
+		if v.IsNull() || !v.IsKnown() {
+			return nil, false
+		}
+		if ty == cty.NilType {
+			ty = v.Type()
+		} else if !v.Type().Equals(ty) {
+			return nil, false
+		}
+	}
+	keys, vVals := valuesByInstanceKey(vals)
+	keyTokens := hclwrite.TokensForTraversal(instanceKeyTraversal(vals))
+
+	switch ty {
+	case cty.Number:
+		// We can only relate numbers to count.index. Any two numbers that
+		// differ by one would match, so we need at least three instances
+		// before we believe that the offset isn't a coincidence.
+		if len(keys) < 3 {
+			return nil, false
+		}
+		offset, ok := indexOffset(keys, func(key interface{}) (int64, bool) {
+			return valueInt(vVals[key])
+		})
+		if !ok {
+			return nil, false
+		}
+		return offsetTokens(keyTokens, offset), true
+
+	case cty.String:
+		strs := make(map[interface{}]string, len(keys))
+		for _, k := range keys {
+			strs[k] = vVals[k].AsString()
+		}
+		if _, isCount := keys[0].(int); isCount {
+			return inferIndexTemplate(keys, strs, keyTokens)
+		}
+		return inferKeyTemplate(keys, strs, keyTokens)
+
+	default:
+		return nil, false
+	}
+}
+
+// inferKeyTemplate tries to find a prefix and suffix which, placed around the
+// each.key of each instance, produce that instance's string.
+func inferKeyTemplate(keys []interface{}, strs map[interface{}]string, keyTokens hclwrite.Tokens) (hclwrite.Tokens, bool) {
+	firstKey := keys[0].(string)
+	first := strs[keys[0]]
+	if firstKey == "" {
+		return nil, false
+	}
+
+	// The key could appear several times in the first string, so we'll
+	// try each one in turn until we find one that works for all of them.
+Candidates:
+	for i := strings.Index(first, firstKey); i >= 0; {
+		prefix, suffix := first[:i], first[i+len(firstKey):]
+		next := strings.Index(first[i+1:], firstKey)
+		if next >= 0 {
+			next += i + 1
+		}
+
+		for _, k := range keys[1:] {
+			if strs[k] != prefix+k.(string)+suffix {
+				i = next
+				continue Candidates
+			}
+		}
+		return templateTokens(prefix, keyTokens, suffix), true
+	}
+	return nil, false
+}
+
+// inferIndexTemplate tries to find a prefix and suffix which, placed around a
+// decimal number that is the count.index of each instance plus some fixed
+// offset, produce that instance's string.
+func inferIndexTemplate(keys []interface{}, strs map[interface{}]string, keyTokens hclwrite.Tokens) (hclwrite.Tokens, bool) {
+	first := strs[keys[0]]
+	firstIdx := keys[0].(int)
+
+	// We'll try each run of digits in the first string in turn, as a
+	// candidate for where the number appears.
+	for start := 0; start < len(first); start++ {
+		if !isDigit(first[start]) {
+			continue
+		}
+		end := start
+		for end < len(first) && isDigit(first[end]) {
+			end++
+		}
+		prefix, digits, suffix := first[:start], first[start:end], first[end:]
+		start = end // skip the rest of this run on the next iteration
+
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			continue
+		}
+		offset := n - int64(firstIdx)
+
+		// A leading zero suggests that the numbers are padded to a fixed
+		// width, which we'll then need to preserve.
+		format := "%d"
+		if len(digits) > 1 && digits[0] == '0' {
+			format = fmt.Sprintf("%%0%dd", len(digits))
+		}
+
+		ok := true
+		for _, k := range keys[1:] {
+			want := prefix + fmt.Sprintf(format, int64(k.(int))+offset) + suffix
+			if strs[k] != want {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		exprTokens := offsetTokens(keyTokens, offset)
+		if format != "%d" {
+			exprTokens = formatCallTokens(format, exprTokens)
+		}
+		return templateTokens(prefix, exprTokens, suffix), true
+	}
+	return nil, false
+}
+
+// indexOffset returns the fixed offset between each of the given count
+// indexes and the integer that the given function returns for it, or false
+// if there is no such offset.
+func indexOffset(keys []interface{}, get func(key interface{}) (int64, bool)) (int64, bool) {
+	var offset int64
+	for i, k := range keys {
+		idx, ok := k.(int)
+		if !ok {
+			return 0, false
+		}
+		n, ok := get(k)
+		if !ok {
+			return 0, false
+		}
+		if i == 0 {
+			offset = n - int64(idx)
+		} else if n-int64(idx) != offset {
+			return 0, false
+		}
+	}
+	return offset, true
+}
+
+// valueInt returns the given number value as an integer, or false if it is
+// not a whole number that fits in an int64.
+func valueInt(v cty.Value) (int64, bool) {
+	bf := v.AsBigFloat()
+	n, acc := bf.Int64()
+	if acc != big.Exact {
+		return 0, false
+	}
+	return n, true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// offsetTokens returns the tokens for the given expression plus the given
+// offset, omitting the arithmetic if the offset is zero.
+func offsetTokens(exprTokens hclwrite.Tokens, offset int64) hclwrite.Tokens {
+	if offset == 0 {
+		return exprTokens
+	}
+	tokens := append(hclwrite.Tokens(nil), exprTokens...)
+	if offset > 0 {
+		tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenPlus, Bytes: []byte{'+'}})
+	} else {
+		tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenMinus, Bytes: []byte{'-'}})
+		offset = -offset
+	}
+	tokens = append(tokens, &hclwrite.Token{
+		Type:  hclsyntax.TokenNumberLit,
+		Bytes: []byte(strconv.FormatInt(offset, 10)),
+	})
+	return tokens
+}
+
+// formatCallTokens returns the tokens for a call to Terraform's format
+// function with the given format string and argument expression.
+func formatCallTokens(format string, argTokens hclwrite.Tokens) hclwrite.Tokens {
+	tokens := hclwrite.Tokens{
+		{Type: hclsyntax.TokenIdent, Bytes: []byte("format")},
+		{Type: hclsyntax.TokenOParen, Bytes: []byte{'('}},
+	}
+	tokens = append(tokens, hclwrite.TokensForValue(cty.StringVal(format))...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenComma, Bytes: []byte{','}})
+	tokens = append(tokens, argTokens...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCParen, Bytes: []byte{')'}})
+	return tokens
+}
+
+// templateTokens returns the tokens for a string template that interpolates
+// the given expression between the given literal prefix and suffix, or just
+// the expression alone if both are empty.
+func templateTokens(prefix string, exprTokens hclwrite.Tokens, suffix string) hclwrite.Tokens {
+	if prefix == "" && suffix == "" {
+		return exprTokens
+	}
+
+	// hclwrite already knows how to escape literal strings, so we'll borrow
+	// the tokens between the quotes of its result.
+	literalTokens := func(s string) hclwrite.Tokens {
+		if s == "" {
+			return nil
+		}
+		tokens := hclwrite.TokensForValue(cty.StringVal(s))
+		return tokens[1 : len(tokens)-1]
+	}
+
+	tokens := hclwrite.Tokens{
+		{Type: hclsyntax.TokenOQuote, Bytes: []byte{'"'}},
+	}
+	tokens = append(tokens, literalTokens(prefix)...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenTemplateInterp, Bytes: []byte("${")})
+	tokens = append(tokens, exprTokens...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenTemplateSeqEnd, Bytes: []byte{'}'}})
+	tokens = append(tokens, literalTokens(suffix)...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCQuote, Bytes: []byte{'"'}})
+	return tokens
+}
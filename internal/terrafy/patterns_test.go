@@ -0,0 +1,201 @@
+package terrafy
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+func TestInferPatternTokens(t *testing.T) {
+	tests := map[string]struct {
+		keys []interface{}
+		vals []cty.Value
+		want string // empty if we expect no pattern
+	}{
+		"single instance": {
+			keys: []interface{}{0},
+			vals: []cty.Value{cty.StringVal("web-1")},
+			want: "",
+		},
+		"each.key alone": {
+			keys: []interface{}{"a", "b"},
+			vals: []cty.Value{cty.StringVal("a"), cty.StringVal("b")},
+			want: "each.key",
+		},
+		"each.key with prefix and suffix": {
+			keys: []interface{}{"a", "b", "c"},
+			vals: []cty.Value{cty.StringVal("web-a.example"), cty.StringVal("web-b.example"), cty.StringVal("web-c.example")},
+			want: `"web-${each.key}.example"`,
+		},
+		"key repeated in the first value": {
+			// The first occurrence of "a" in "data-a" is in the prefix,
+			// so we must try the later one too.
+			keys: []interface{}{"a", "b"},
+			vals: []cty.Value{cty.StringVal("data-a"), cty.StringVal("data-b")},
+			want: `"data-${each.key}"`,
+		},
+		"key repeated in every value": {
+			keys: []interface{}{"a", "b"},
+			vals: []cty.Value{cty.StringVal("a-a"), cty.StringVal("b-b")},
+			want: "",
+		},
+		"key template needing escapes": {
+			keys: []interface{}{"a", "b"},
+			vals: []cty.Value{cty.StringVal("${a}"), cty.StringVal("${b}")},
+			want: `"$${${each.key}}"`,
+		},
+		"count.index": {
+			keys: []interface{}{0, 1, 2},
+			vals: []cty.Value{cty.StringVal("host-0"), cty.StringVal("host-1"), cty.StringVal("host-2")},
+			want: `"host-${count.index}"`,
+		},
+		"count.index with positive offset": {
+			keys: []interface{}{0, 1, 2},
+			vals: []cty.Value{cty.StringVal("host-1"), cty.StringVal("host-2"), cty.StringVal("host-3")},
+			want: `"host-${count.index + 1}"`,
+		},
+		"count.index with negative offset": {
+			keys: []interface{}{2, 3},
+			vals: []cty.Value{cty.StringVal("host-0"), cty.StringVal("host-1")},
+			want: `"host-${count.index - 2}"`,
+		},
+		"zero-padded count.index": {
+			keys: []interface{}{0, 1, 9},
+			vals: []cty.Value{cty.StringVal("host-001"), cty.StringVal("host-002"), cty.StringVal("host-010")},
+			want: `"host-${format("%03d", count.index + 1)}"`,
+		},
+		"zero-padded with inconsistent width": {
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.StringVal("host-01"), cty.StringVal("host-002")},
+			want: "",
+		},
+		"number in a later run of digits": {
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.StringVal("v2-host-5"), cty.StringVal("v2-host-6")},
+			want: `"v2-host-${count.index + 5}"`,
+		},
+		"count.index as a number": {
+			keys: []interface{}{0, 1, 2},
+			vals: []cty.Value{cty.NumberIntVal(10), cty.NumberIntVal(11), cty.NumberIntVal(12)},
+			want: "count.index + 10",
+		},
+		"numbers with no fixed offset": {
+			keys: []interface{}{0, 1, 2},
+			vals: []cty.Value{cty.NumberIntVal(80), cty.NumberIntVal(81), cty.NumberIntVal(443)},
+			want: "",
+		},
+		"fractional numbers": {
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.NumberFloatVal(0.5), cty.NumberFloatVal(1.5)},
+			want: "",
+		},
+		"numbers with for_each": {
+			keys: []interface{}{"a", "b"},
+			vals: []cty.Value{cty.NumberIntVal(1), cty.NumberIntVal(2)},
+			want: "",
+		},
+		"two instances matching by coincidence": {
+			// With only two instances almost any pair of numbers that
+			// differ by one looks like a pattern, such as two ports.
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.NumberIntVal(8080), cty.NumberIntVal(8081)},
+			want: "",
+		},
+		"null value": {
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.StringVal("host-0"), cty.NullVal(cty.String)},
+			want: "",
+		},
+		"unsupported type": {
+			keys: []interface{}{0, 1},
+			vals: []cty.Value{cty.True, cty.False},
+			want: "",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			vals := patternTestValues(test.keys, test.vals)
+			tokens, ok := inferPatternTokens(vals)
+			if test.want == "" {
+				if ok {
+					t.Fatalf("unexpected pattern %s", formatExprTokens(tokens))
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("no pattern found; want %s", test.want)
+			}
+			if got := formatExprTokens(tokens); got != test.want {
+				t.Fatalf("wrong pattern\ngot:  %s\nwant: %s", got, test.want)
+			}
+
+			// The expression must also produce the original value for
+			// every instance.
+			expr, diags := hclsyntax.ParseExpression(tokens.Bytes(), "", hcl.InitialPos)
+			if diags.HasErrors() {
+				t.Fatalf("invalid expression: %s", diags.Error())
+			}
+			for addr, want := range vals {
+				got, diags := expr.Value(patternTestEvalContext(addr.InstanceKey))
+				if diags.HasErrors() {
+					t.Fatalf("failed to evaluate for %s: %s", addr, diags.Error())
+				}
+				if !got.RawEquals(want) {
+					t.Errorf("wrong result for %s\ngot:  %#v\nwant: %#v", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func patternTestValues(keys []interface{}, vals []cty.Value) map[resourceInstanceAddr]cty.Value {
+	ret := make(map[resourceInstanceAddr]cty.Value, len(keys))
+	for i, key := range keys {
+		addr := resourceInstanceAddr{
+			Resource: resourceAddr{
+				Mode: tfjson.ManagedResourceMode,
+				Type: "test_thing",
+				Name: "test",
+			},
+			InstanceKey: key,
+		}
+		ret[addr] = vals[i]
+	}
+	return ret
+}
+
+func patternTestEvalContext(key interface{}) *hcl.EvalContext {
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{},
+		Functions: map[string]function.Function{
+			"format": stdlib.FormatFunc,
+		},
+	}
+	switch key := key.(type) {
+	case int:
+		ctx.Variables["count"] = cty.ObjectVal(map[string]cty.Value{
+			"index": cty.NumberIntVal(int64(key)),
+		})
+	case string:
+		ctx.Variables["each"] = cty.ObjectVal(map[string]cty.Value{
+			"key": cty.StringVal(key),
+		})
+	}
+	return ctx
+}
+
+// formatExprTokens returns the given expression tokens as they'd appear in
+// a formatted configuration file.
+func formatExprTokens(tokens hclwrite.Tokens) string {
+	f := hclwrite.NewEmptyFile()
+	f.Body().SetAttributeRaw("v", tokens)
+	src := string(hclwrite.Format(f.Bytes()))
+	return src[len("v = ") : len(src)-1]
+}
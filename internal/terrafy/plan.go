@@ -5,6 +5,31 @@ import "sort"
 type importPlan struct {
 	ToState  []*importPlanState
 	ToConfig []*importPlanConfig
+
+	// IDs is the raw value of the "ids" output from the temporary
+	// configuration, retained only so that a saved plan can show the
+	// reviewer where the ids in ToState came from.
+	IDs map[string]interface{}
+
+	// SourcesFingerprint and State record the configuration and state
+	// that the plan was created against, so that we can detect if either
+	// has changed before applying a saved plan.
+	SourcesFingerprint string
+	State              stateMeta
+
+	// ImportBlocksFile, if set, is the file where the items in ToState
+	// will be written as import blocks, rather than being imported
+	// directly into the state.
+	ImportBlocksFile string
+
+	// Generated lists the resources that an earlier apply of the same plan
+	// already generated configuration for, when resuming that apply. The
+	// resources we generate now can still refer to them.
+	Generated []resourceAddr
+}
+
+func (p *importPlan) Empty() bool {
+	return len(p.ToState) == 0 && len(p.ToConfig) == 0
 }
 
 type importPlanState struct {
@@ -16,6 +41,20 @@ type importPlanConfig struct {
 	Target     resourceAddr
 	RepeatMode string // "", "count", or "for_each"
 	Filename   string
+
+	// Provider, if not empty, is the address of the non-default provider
+	// configuration that the generated resource block will select.
+	Provider string
+
+	// Template is the content of the import block's generate block, which
+	// will be copied into the generated resource block.
+	Template string
+
+	// IgnoreAttributes, OnlyAttributes, and Overrides are from the fields
+	// of the same names in ImportConfig.
+	IgnoreAttributes []string
+	OnlyAttributes   []string
+	Overrides        map[string]string
 }
 
 func (p *importPlan) Sort() {
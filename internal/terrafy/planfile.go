@@ -0,0 +1,278 @@
+package terrafy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// planFileFormatVersion is the version of the saved plan file format written
+// by writePlanFile. We'll increment this if we make any incompatible changes
+// to the format, so that readPlanFile can reject plans it can't understand.
+const planFileFormatVersion = 1
+
+// planFile is the JSON representation of an importPlan, as saved by
+// "terrafy plan -out=FILE".
+type planFile struct {
+	FormatVersion      int                    `json:"format_version"`
+	SourcesFingerprint string                 `json:"sources_fingerprint"`
+	StateLineage       string                 `json:"state_lineage,omitempty"`
+	StateSerial        uint64                 `json:"state_serial"`
+	IDs                map[string]interface{} `json:"ids"`
+	ImportBlocksFile   string                 `json:"import_blocks_file,omitempty"`
+	ToState            []planFileState        `json:"to_state"`
+	ToConfig           []planFileConfig       `json:"to_config"`
+}
+
+type planFileResource struct {
+	Module string `json:"module,omitempty"`
+	Mode   string `json:"mode"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+}
+
+type planFileState struct {
+	Resource planFileResource `json:"resource"`
+	Key      interface{}      `json:"key,omitempty"`
+	ID       string           `json:"id"`
+}
+
+type planFileConfig struct {
+	Resource   planFileResource `json:"resource"`
+	RepeatMode string           `json:"repeat_mode,omitempty"`
+	Filename   string           `json:"filename"`
+	Provider   string           `json:"provider,omitempty"`
+	Template   string           `json:"generate,omitempty"`
+
+	IgnoreAttributes []string          `json:"ignore_attributes,omitempty"`
+	OnlyAttributes   []string          `json:"only_attributes,omitempty"`
+	Overrides        map[string]string `json:"overrides,omitempty"`
+}
+
+func newPlanFileResource(addr resourceAddr) planFileResource {
+	return planFileResource{
+		Module: addr.Module,
+		Mode:   string(addr.Mode),
+		Type:   addr.Type,
+		Name:   addr.Name,
+	}
+}
+
+func (r planFileResource) addr() (resourceAddr, error) {
+	addr := resourceAddr{
+		Module: r.Module,
+		Mode:   tfjson.ResourceMode(r.Mode),
+		Type:   r.Type,
+		Name:   r.Name,
+	}
+	if addr.Mode != tfjson.ManagedResourceMode && addr.Mode != tfjson.DataResourceMode {
+		return addr, fmt.Errorf("invalid resource mode %q", r.Mode)
+	}
+	if _, ok := moduleStepsFromString(addr.Module); !ok {
+		return addr, fmt.Errorf("invalid module address %q", r.Module)
+	}
+	return addr, nil
+}
+
+func (s planFileState) addr() (resourceInstanceAddr, error) {
+	addr, err := s.Resource.addr()
+	if err != nil {
+		return resourceInstanceAddr{}, err
+	}
+	instAddr := resourceInstanceAddr{Resource: addr}
+	switch k := s.Key.(type) {
+	case nil:
+		// no instance key
+	case string:
+		instAddr.InstanceKey = k
+	case float64:
+		// encoding/json decodes all numbers as float64
+		instAddr.InstanceKey = int(k)
+	default:
+		return instAddr, fmt.Errorf("invalid instance key for %s", addr)
+	}
+	return instAddr, nil
+}
+
+// writePlanFile saves the given plan to the given filename, in a format that
+// readPlanFile can later read.
+//
+// Target filenames in the plan are recorded relative to dir, so that a saved
+// plan can be applied from a different current working directory.
+func writePlanFile(filename string, plan *importPlan, dir string) error {
+	pf, err := newPlanFile(plan, dir)
+	if err != nil {
+		return err
+	}
+
+	src, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	src = append(src, '\n')
+	return ioutil.WriteFile(filename, src, 0644)
+}
+
+// newPlanFile returns the JSON representation of the given plan, with the
+// target filenames relative to dir.
+func newPlanFile(plan *importPlan, dir string) (*planFile, error) {
+	pf := &planFile{
+		FormatVersion:      planFileFormatVersion,
+		SourcesFingerprint: plan.SourcesFingerprint,
+		StateLineage:       plan.State.Lineage,
+		StateSerial:        plan.State.Serial,
+		IDs:                plan.IDs,
+		ToState:            make([]planFileState, 0, len(plan.ToState)),
+		ToConfig:           make([]planFileConfig, 0, len(plan.ToConfig)),
+	}
+	if plan.ImportBlocksFile != "" {
+		relFilename, err := filepath.Rel(dir, plan.ImportBlocksFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid import blocks filename: %s", err)
+		}
+		pf.ImportBlocksFile = filepath.ToSlash(relFilename)
+	}
+	for _, item := range plan.ToState {
+		pf.ToState = append(pf.ToState, planFileState{
+			Resource: newPlanFileResource(item.Target.Resource),
+			Key:      item.Target.InstanceKey,
+			ID:       item.ID,
+		})
+	}
+	for _, item := range plan.ToConfig {
+		relFilename, err := filepath.Rel(dir, item.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target filename for %s: %s", item.Target, err)
+		}
+		pf.ToConfig = append(pf.ToConfig, planFileConfig{
+			Resource:   newPlanFileResource(item.Target),
+			RepeatMode: item.RepeatMode,
+			Filename:   filepath.ToSlash(relFilename),
+			Provider:   item.Provider,
+			Template:   item.Template,
+
+			IgnoreAttributes: item.IgnoreAttributes,
+			OnlyAttributes:   item.OnlyAttributes,
+			Overrides:        item.Overrides,
+		})
+	}
+	return pf, nil
+}
+
+// readPlanFile loads a plan previously saved by writePlanFile, resolving
+// the target filenames relative to dir.
+func readPlanFile(filename string, dir string) (*importPlan, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var pf planFile
+	err = json.Unmarshal(src, &pf)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid Terrafy plan file: %s", err)
+	}
+	return pf.plan(dir)
+}
+
+// plan returns the importPlan that the plan file represents, resolving
+// the target filenames relative to dir.
+func (pf *planFile) plan(dir string) (*importPlan, error) {
+	if pf.FormatVersion != planFileFormatVersion {
+		return nil, fmt.Errorf("unsupported plan file format version %d; this version of Terrafy supports only version %d", pf.FormatVersion, planFileFormatVersion)
+	}
+
+	plan := &importPlan{
+		IDs:                pf.IDs,
+		SourcesFingerprint: pf.SourcesFingerprint,
+		State: stateMeta{
+			Lineage: pf.StateLineage,
+			Serial:  pf.StateSerial,
+		},
+	}
+	if pf.ImportBlocksFile != "" {
+		plan.ImportBlocksFile = filepath.Join(dir, filepath.FromSlash(pf.ImportBlocksFile))
+	}
+	for _, item := range pf.ToState {
+		instAddr, err := item.addr()
+		if err != nil {
+			return nil, err
+		}
+		plan.ToState = append(plan.ToState, &importPlanState{
+			Target: instAddr,
+			ID:     item.ID,
+		})
+	}
+	for _, item := range pf.ToConfig {
+		addr, err := item.Resource.addr()
+		if err != nil {
+			return nil, err
+		}
+		switch item.RepeatMode {
+		case "", "count", "for_each":
+			// valid
+		default:
+			return nil, fmt.Errorf("invalid repetition mode %q for %s", item.RepeatMode, addr)
+		}
+		if item.Provider != "" {
+			traversal, diags := hclsyntax.ParseTraversalAbs([]byte(item.Provider), "", hcl.InitialPos)
+			if diags.HasErrors() || len(traversal) > 2 {
+				return nil, fmt.Errorf("invalid provider configuration %q for %s", item.Provider, addr)
+			}
+		}
+		plan.ToConfig = append(plan.ToConfig, &importPlanConfig{
+			Target:     addr,
+			RepeatMode: item.RepeatMode,
+			Filename:   filepath.Join(dir, filepath.FromSlash(item.Filename)),
+			Provider:   item.Provider,
+			Template:   item.Template,
+
+			IgnoreAttributes: item.IgnoreAttributes,
+			OnlyAttributes:   item.OnlyAttributes,
+			Overrides:        item.Overrides,
+		})
+	}
+	plan.Sort()
+
+	return plan, nil
+}
+
+// sourcesFingerprint returns a string that will change if any of the given
+// configuration source files change.
+//
+// We include the .tf files along with the .tfy files here because they
+// decide which resources already have configuration blocks and which files
+// we'll append new blocks to.
+func sourcesFingerprint(files map[string]*hcl.File, dir string) string {
+	// We use the names relative to dir so that the fingerprint doesn't
+	// change depending on how the working directory was specified, but
+	// files in child modules still have distinct names.
+	names := make(map[string]string, len(files))
+	filenames := make([]string, 0, len(files))
+	for fn := range files {
+		name := fn
+		if rel, err := filepath.Rel(dir, fn); err == nil {
+			name = rel
+		}
+		names[fn] = filepath.ToSlash(name)
+		filenames = append(filenames, fn)
+	}
+	sort.Slice(filenames, func(i, j int) bool {
+		return names[filenames[i]] < names[filenames[j]]
+	})
+
+	h := sha256.New()
+	for _, fn := range filenames {
+		fmt.Fprintf(h, "%s\x00%d\x00", names[fn], len(files[fn].Bytes))
+		h.Write(files[fn].Bytes)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
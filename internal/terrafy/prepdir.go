@@ -0,0 +1,124 @@
+package terrafy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// prepDir is a temporary Terraform working directory where Terrafy runs
+// Terraform against the configuration it generates from the .tfy files,
+// separately from the user's real working directory.
+type prepDir struct {
+	Dir string
+	TF  *tfexec.Terraform
+
+	// Vars and VarFiles are the values for the input variables declared
+	// in the .tfy files, in the same forms as Terraform's -var and -var-file
+	// options. The VarFiles paths are absolute, because Terraform runs in
+	// the temporary directory.
+	Vars     []string
+	VarFiles []string
+}
+
+// newPrepDir creates a new, empty temporary working directory. The caller
+// must call Close on the result once it's no longer needed.
+func newPrepDir(opts *Options) (*prepDir, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	tmpDir, err := ioutil.TempDir("", "terrafy-")
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to create temporary directory",
+			Detail:   fmt.Sprintf("Could not create a temporary working directory: %s.", err),
+		})
+		return nil, diags
+	}
+
+	tf, err := tfexec.NewTerraform(tmpDir, opts.TerraformExec)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to initialize Terraform CLI",
+			Detail:   fmt.Sprintf("Terraform executable at %s is malfunctioning or not available: %s.", opts.TerraformExec, err),
+		})
+		return nil, diags
+	}
+
+	// The variables files are relative to the main working directory,
+	// as they would be when running Terraform there.
+	varFiles := make([]string, len(opts.VarFiles))
+	for i, fn := range opts.VarFiles {
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(opts.dir(), fn)
+		}
+		absFn, err := filepath.Abs(fn)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid variables file",
+				Detail:   fmt.Sprintf("Could not resolve the path of variables file %s: %s.", opts.VarFiles[i], err),
+			})
+			return nil, diags
+		}
+		varFiles[i] = absFn
+	}
+
+	return &prepDir{
+		Dir:      tmpDir,
+		TF:       tf,
+		Vars:     opts.Vars,
+		VarFiles: varFiles,
+	}, diags
+}
+
+// VarArgs returns the command line arguments to pass the input variable
+// values to Terraform when running it directly with runTerraform.
+func (d *prepDir) VarArgs() []string {
+	var args []string
+	for _, fn := range d.VarFiles {
+		args = append(args, "-var-file="+fn)
+	}
+	for _, assignment := range d.Vars {
+		args = append(args, "-var="+assignment)
+	}
+	return args
+}
+
+// ApplyOptions returns the tfexec options to pass the input variable values
+// to "terraform apply".
+func (d *prepDir) ApplyOptions() []tfexec.ApplyOption {
+	var opts []tfexec.ApplyOption
+	for _, fn := range d.VarFiles {
+		opts = append(opts, tfexec.VarFile(fn))
+	}
+	for _, assignment := range d.Vars {
+		opts = append(opts, tfexec.Var(assignment))
+	}
+	return opts
+}
+
+// ImportOptions returns the tfexec options to pass the input variable values
+// to "terraform import", along with any other given options.
+func (d *prepDir) ImportOptions(extra ...tfexec.ImportOption) []tfexec.ImportOption {
+	var opts []tfexec.ImportOption
+	for _, fn := range d.VarFiles {
+		opts = append(opts, tfexec.VarFile(fn))
+	}
+	for _, assignment := range d.Vars {
+		opts = append(opts, tfexec.Var(assignment))
+	}
+	return append(opts, extra...)
+}
+
+// Close deletes the temporary directory and everything in it.
+func (d *prepDir) Close() error {
+	return os.RemoveAll(d.Dir)
+}
@@ -0,0 +1,152 @@
+package terrafy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// providerStubsFile is the name of the temporary file where Terrafy declares
+// the resources that use non-default provider configurations while it's
+// importing them.
+const providerStubsFile = "terrafy-provider-stubs.tf"
+
+// writeProviderStubs writes temporary resource blocks for each of the
+// resources in the plan that must use a non-default provider configuration.
+//
+// "terraform import" uses the provider configuration that the resource
+// declares in the configuration, if any, and otherwise the default
+// configuration for its type, so we must declare the resource with its
+// provider argument while importing. The stub blocks then go away again
+// before we generate the real ones.
+//
+// The dir argument, if not empty, overrides the directory where all of the
+// stubs are written, for importing in the temporary working directory.
+// The caller must call the returned function to remove the stubs, even if
+// there are errors.
+func writeProviderStubs(plan *importPlan, dir string) (func() hcl.Diagnostics, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	keys := map[resourceAddr]map[interface{}]bool{}
+	for _, action := range plan.ToState {
+		addr := action.Target.Resource.ConfigAddr()
+		if keys[addr] == nil {
+			keys[addr] = map[interface{}]bool{}
+		}
+		keys[addr][action.Target.InstanceKey] = true
+	}
+
+	files := map[string]*hclwrite.File{}
+	var filenames []string
+	for _, action := range plan.ToConfig {
+		if action.Provider == "" || len(keys[action.Target]) == 0 {
+			continue
+		}
+		stubDir := dir
+		if stubDir == "" {
+			stubDir = filepath.Dir(action.Filename)
+		}
+		filename := filepath.Join(stubDir, providerStubsFile)
+		f, exists := files[filename]
+		if !exists {
+			f = hclwrite.NewEmptyFile()
+			files[filename] = f
+			filenames = append(filenames, filename)
+		} else {
+			f.Body().AppendNewline()
+		}
+
+		block := f.Body().AppendNewBlock("resource", []string{action.Target.Type, action.Target.Name})
+		body := block.Body()
+		switch action.RepeatMode {
+		case "count":
+			highest := -1
+			for k := range keys[action.Target] {
+				if v, ok := k.(int); ok && v > highest {
+					highest = v
+				}
+			}
+			body.SetAttributeValue("count", cty.NumberIntVal(int64(highest+1)))
+		case "for_each":
+			var strs []string
+			for k := range keys[action.Target] {
+				if v, ok := k.(string); ok {
+					strs = append(strs, v)
+				}
+			}
+			sort.Strings(strs)
+			elems := make([]cty.Value, len(strs))
+			for i, s := range strs {
+				elems[i] = cty.StringVal(s)
+			}
+			tokens := hclwrite.Tokens{
+				{Type: hclsyntax.TokenIdent, Bytes: []byte("toset")},
+				{Type: hclsyntax.TokenOParen, Bytes: []byte{'('}},
+			}
+			if len(elems) == 0 {
+				tokens = append(tokens, hclwrite.TokensForValue(cty.EmptyTupleVal)...)
+			} else {
+				tokens = append(tokens, hclwrite.TokensForValue(cty.TupleVal(elems))...)
+			}
+			tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCParen, Bytes: []byte{')'}})
+			body.SetAttributeRaw("for_each", tokens)
+		}
+		body.SetAttributeTraversal("provider", providerConfigTraversal(action.Provider))
+	}
+
+	var written []string
+	cleanup := func() hcl.Diagnostics {
+		var diags hcl.Diagnostics
+		for _, filename := range written {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Failed to remove temporary configuration",
+					Detail:   fmt.Sprintf("Could not remove %s: %s. Delete this file before running Terraform in this directory.", filename, err),
+				})
+			}
+		}
+		written = nil
+		return diags
+	}
+
+	for _, filename := range filenames {
+		if _, err := os.Stat(filename); err == nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Temporary configuration file already exists",
+				Detail:   fmt.Sprintf("Terrafy needs to write a temporary file %s, but a file of that name already exists. If it was left behind by an earlier run of Terrafy, delete it and try again.", filename),
+			})
+			return cleanup, diags
+		}
+		if err := ioutil.WriteFile(filename, files[filename].Bytes(), 0644); err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to write temporary configuration",
+				Detail:   fmt.Sprintf("Could not write %s: %s.", filename, err),
+			})
+			return cleanup, diags
+		}
+		written = append(written, filename)
+	}
+	return cleanup, diags
+}
+
+// providerConfigTraversal returns the traversal for the given provider
+// configuration address, such as "aws.west".
+func providerConfigTraversal(addr string) hcl.Traversal {
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(addr), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		// Should never happen, because we validated the address when we
+		// first decoded it.
+		panic(fmt.Sprintf("invalid provider configuration address %q", addr))
+	}
+	return traversal
+}
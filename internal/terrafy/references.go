@@ -0,0 +1,318 @@
+package terrafy
+
+import (
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// identifyingAttributes are the names of the attributes whose values tend to
+// uniquely identify a remote object, and which therefore other resources are
+// likely to use to refer to that object. When one object has the same value
+// for several of these, we prefer the one that appears first.
+var identifyingAttributes = []string{"id", "arn", "self_link", "name"}
+
+// referenceArgumentSuffixes are the suffixes of the names of arguments that
+// we expect to refer to other objects by name. A name is much less likely
+// than an id to be unique, and so we only match names in these arguments,
+// rather than in arbitrary strings like descriptions and tags.
+var referenceArgumentSuffixes = []string{"_name", "_names", "_id", "_ids", "_arn", "_arns"}
+
+// referenceTarget is an attribute of a resource instance that a generated
+// argument could refer to instead of repeating its value.
+type referenceTarget struct {
+	Instance resourceInstanceAddr
+	Attr     string
+}
+
+// referenceIndex helps to infer references between the resources that
+// Terrafy is generating configuration for, by recording the values of their
+// identifying attributes.
+//
+// It also tracks the references that we've already generated, so that we
+// can avoid generating any that would create a dependency cycle.
+type referenceIndex struct {
+	targets map[string][]referenceTarget
+	deps    map[resourceAddr]map[resourceAddr]bool
+}
+
+// newReferenceIndex indexes the identifying attributes of those of the given
+// resource instances that belong to the given resources.
+func newReferenceIndex(instances []stateResource, resources map[resourceAddr]bool) *referenceIndex {
+	ret := &referenceIndex{
+		targets: map[string][]referenceTarget{},
+		deps:    map[resourceAddr]map[resourceAddr]bool{},
+	}
+	for _, rs := range instances {
+		instAddr := rs.InstanceAddr()
+		if !resources[instAddr.Resource.ConfigAddr()] {
+			continue
+		}
+	Attrs:
+		for _, name := range identifyingAttributes {
+			v, ok := rs.AttributeValues[name].(string)
+			if !ok || v == "" {
+				continue
+			}
+			for _, existing := range ret.targets[v] {
+				if existing.Instance == instAddr {
+					// This value was already recorded for an attribute
+					// that we prefer.
+					continue Attrs
+				}
+			}
+			ret.targets[v] = append(ret.targets[v], referenceTarget{
+				Instance: instAddr,
+				Attr:     name,
+			})
+		}
+	}
+	return ret
+}
+
+// lookup returns the only attribute that has the given value, if it's one
+// that the given argument of the given resource can refer to. Instances of
+// the referring resource must all belong to the given module instance.
+func (idx *referenceIndex) lookup(from resourceAddr, module string, argName string, v string) (referenceTarget, bool) {
+	candidates := idx.targets[v]
+	if len(candidates) != 1 {
+		// If several objects have the same value then we can't tell
+		// which one is intended.
+		return referenceTarget{}, false
+	}
+	target := candidates[0]
+	if target.Instance.Resource.Module != module {
+		return referenceTarget{}, false
+	}
+	if target.Attr == "name" && !isReferenceArgument(argName) {
+		return referenceTarget{}, false
+	}
+	to := target.Instance.Resource.ConfigAddr()
+	if to == from || idx.dependsOn(to, from) {
+		return referenceTarget{}, false
+	}
+	return target, true
+}
+
+// isReferenceArgument returns true if the argument with the given name looks
+// like it refers to another object, according to referenceArgumentSuffixes.
+func isReferenceArgument(name string) bool {
+	for _, suffix := range referenceArgumentSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependsOn returns true if the configuration for resource a refers to
+// resource b, either directly or indirectly.
+func (idx *referenceIndex) dependsOn(a, b resourceAddr) bool {
+	seen := map[resourceAddr]bool{}
+	next := []resourceAddr{a}
+	for len(next) != 0 {
+		addr := next[len(next)-1]
+		next = next[:len(next)-1]
+		if addr == b {
+			return true
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		for dep := range idx.deps[addr] {
+			next = append(next, dep)
+		}
+	}
+	return false
+}
+
+// addDep records that the configuration for resource a refers to resource b.
+func (idx *referenceIndex) addDep(a, b resourceAddr) {
+	if idx.deps[a] == nil {
+		idx.deps[a] = map[resourceAddr]bool{}
+	}
+	idx.deps[a][b] = true
+}
+
+// addConfigDeps records the references to the given resources in the
+// existing configuration block for resource from. We only look for them in
+// the native syntax, which is what Terrafy generates by default.
+func (idx *referenceIndex) addConfigDeps(from resourceAddr, block *hcl.Block, resources map[resourceAddr]bool) {
+	body, ok := block.Body.(*hclsyntax.Body)
+	if !ok {
+		return
+	}
+	hclsyntax.VisitAll(body, func(node hclsyntax.Node) hcl.Diagnostics {
+		expr, ok := node.(*hclsyntax.ScopeTraversalExpr)
+		if !ok || len(expr.Traversal) < 2 {
+			return nil
+		}
+		attr, ok := expr.Traversal[1].(hcl.TraverseAttr)
+		if !ok {
+			return nil
+		}
+		to := resourceAddr{
+			Module: from.Module,
+			Mode:   tfjson.ManagedResourceMode,
+			Type:   expr.Traversal.RootName(),
+			Name:   attr.Name,
+		}
+		if resources[to] && to != from {
+			idx.addDep(from, to)
+		}
+		return nil
+	})
+}
+
+// referenceTokens tries to find an expression that refers to other resources
+// in order to produce the given values of the argument with the given name
+// in the given resource. It returns false if there is no suitable expression.
+//
+// If all of the instances have the same value then the result can refer to
+// a single instance of another resource. Otherwise, it can refer to the
+// instances of another resource with the same instance keys.
+func (idx *referenceIndex) referenceTokens(from resourceAddr, argName string, vals map[resourceInstanceAddr]cty.Value) (hclwrite.Tokens, bool) {
+	if len(vals) == 0 {
+		return nil, false
+	}
+	module, ok := singleModuleInstance(vals)
+
+	if singleVal := singleValue(vals); singleVal != cty.NilVal {
+		if !ok || singleVal.IsNull() || !singleVal.IsWhollyKnown() {
+			return nil, false
+		}
+		ty := singleVal.Type()
+		switch {
+		case ty == cty.String:
+			target, ok := idx.lookup(from, module, argName, singleVal.AsString())
+			if !ok {
+				return nil, false
+			}
+			idx.addDep(from, target.Instance.Resource.ConfigAddr())
+			return targetTokens(target, targetKeyTokens(target.Instance.InstanceKey)), true
+
+		case (ty.IsListType() || ty.IsSetType()) && ty.ElementType() == cty.String:
+			// For a collection of ids we can refer to whichever of them
+			// we can find, and leave the others as they are.
+			var tokens hclwrite.Tokens
+			tokens = append(tokens,
+				&hclwrite.Token{Type: hclsyntax.TokenOBrack, Bytes: []byte{'['}},
+				&hclwrite.Token{Type: hclsyntax.TokenNewline, Bytes: []byte{'\n'}},
+			)
+			// We only record the dependencies once we know that we'll
+			// actually generate the references.
+			var deps []resourceAddr
+			for it := singleVal.ElementIterator(); it.Next(); {
+				_, elem := it.Element()
+				if elem.IsNull() {
+					return nil, false
+				}
+				if target, ok := idx.lookup(from, module, argName, elem.AsString()); ok {
+					deps = append(deps, target.Instance.Resource.ConfigAddr())
+					tokens = append(tokens, targetTokens(target, targetKeyTokens(target.Instance.InstanceKey))...)
+				} else {
+					tokens = append(tokens, hclwrite.TokensForValue(elem)...)
+				}
+				tokens = append(tokens,
+					&hclwrite.Token{Type: hclsyntax.TokenComma, Bytes: []byte{','}},
+					&hclwrite.Token{Type: hclsyntax.TokenNewline, Bytes: []byte{'\n'}},
+				)
+			}
+			tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte{']'}})
+			if len(deps) == 0 {
+				return nil, false
+			}
+			for _, dep := range deps {
+				idx.addDep(from, dep)
+			}
+			return tokens, true
+
+		default:
+			return nil, false
+		}
+	}
+
+	// If the values differ between instances then we can only refer to
+	// the instances of another resource that have the same keys, and they
+	// must all be the same attribute of the same resource.
+	var found referenceTarget
+	for instAddr, v := range vals {
+		if v.IsNull() || !v.IsKnown() || v.Type() != cty.String {
+			return nil, false
+		}
+		target, ok := idx.lookup(from, instAddr.Resource.Module, argName, v.AsString())
+		if !ok || target.Instance.InstanceKey != instAddr.InstanceKey {
+			return nil, false
+		}
+		if found.Attr != "" && (found.Attr != target.Attr || found.Instance.Resource != target.Instance.Resource.ConfigAddr()) {
+			return nil, false
+		}
+		found = referenceTarget{
+			// We use the configuration address here because the targets
+			// might belong to several instances of the same module.
+			Instance: resourceInstanceAddr{Resource: target.Instance.Resource.ConfigAddr()},
+			Attr:     target.Attr,
+		}
+	}
+	idx.addDep(from, found.Instance.Resource)
+
+	var keyTokens hclwrite.Tokens
+	keyTokens = append(keyTokens, &hclwrite.Token{Type: hclsyntax.TokenOBrack, Bytes: []byte{'['}})
+	keyTokens = append(keyTokens, hclwrite.TokensForTraversal(instanceKeyTraversal(vals))...)
+	keyTokens = append(keyTokens, &hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte{']'}})
+	return targetTokens(found, keyTokens), true
+}
+
+// singleModuleInstance returns the module instance that all of the instances
+// of the given values belong to, or false if they belong to several.
+func singleModuleInstance(vals map[resourceInstanceAddr]cty.Value) (string, bool) {
+	var module string
+	first := true
+	for instAddr := range vals {
+		if !first && instAddr.Resource.Module != module {
+			return "", false
+		}
+		module = instAddr.Resource.Module
+		first = false
+	}
+	return module, true
+}
+
+// targetKeyTokens returns the tokens for an index step selecting the given
+// instance key, or no tokens if the instance key is nil.
+func targetKeyTokens(key interface{}) hclwrite.Tokens {
+	var keyVal cty.Value
+	switch key := key.(type) {
+	case int:
+		keyVal = cty.NumberIntVal(int64(key))
+	case string:
+		keyVal = cty.StringVal(key)
+	default:
+		return nil
+	}
+	var tokens hclwrite.Tokens
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenOBrack, Bytes: []byte{'['}})
+	tokens = append(tokens, hclwrite.TokensForValue(keyVal)...)
+	tokens = append(tokens, &hclwrite.Token{Type: hclsyntax.TokenCBrack, Bytes: []byte{']'}})
+	return tokens
+}
+
+// targetTokens returns the tokens for a reference to the attribute of the
+// given target, with the given tokens selecting the instance.
+func targetTokens(target referenceTarget, keyTokens hclwrite.Tokens) hclwrite.Tokens {
+	tokens := hclwrite.TokensForTraversal(hcl.Traversal{
+		hcl.TraverseRoot{Name: target.Instance.Resource.Type},
+		hcl.TraverseAttr{Name: target.Instance.Resource.Name},
+	})
+	tokens = append(tokens, keyTokens...)
+	tokens = append(tokens,
+		&hclwrite.Token{Type: hclsyntax.TokenDot, Bytes: []byte{'.'}},
+		&hclwrite.Token{Type: hclsyntax.TokenIdent, Bytes: []byte(target.Attr)},
+	)
+	return tokens
+}
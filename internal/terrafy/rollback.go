@@ -0,0 +1,236 @@
+package terrafy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+const (
+	// rollbackRemove undoes a failed apply by removing the instances that
+	// it imported from the state.
+	rollbackRemove = "remove"
+
+	// rollbackRestore undoes a failed apply by pushing the state snapshot
+	// that we saved before starting.
+	rollbackRestore = "restore"
+)
+
+// stateBackupFile is the name of the file where Terrafy saves a copy of
+// the latest state snapshot before importing, when rollback is enabled. It
+// lives in the .terraform directory alongside Terraform's own working
+// files, so that it won't be committed to version control by mistake.
+var stateBackupFile = filepath.Join(".terraform", "terrafy-backup.tfstate")
+
+// importTransaction tracks the changes that applyImporting has made so far,
+// so that they can be undone if a later step fails. A nil *importTransaction
+// is valid and tracks nothing, for when rollback is disabled.
+type importTransaction struct {
+	opts       *Options
+	mode       string
+	backupFile string
+	hadState   bool
+
+	imported  []resourceInstanceAddr
+	committed bool
+
+	// files records the original content and mode of each configuration
+	// file that we've modified, or nil if the file didn't exist.
+	files     map[string]*originalFile
+	fileOrder []string
+}
+
+// originalFile is the content and mode of a file before we modified it.
+type originalFile struct {
+	src  []byte
+	mode os.FileMode
+}
+
+// checkRollbackSupport returns error diagnostics if it won't be possible to
+// roll back a failed apply of the given plan using the given mode.
+func checkRollbackSupport(plan *importPlan, mode string) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	switch mode {
+	case rollbackRemove, rollbackRestore:
+		// valid
+	default:
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid rollback mode",
+			Detail:   fmt.Sprintf("The -rollback option must be either %q or %q.", rollbackRemove, rollbackRestore),
+		})
+		return diags
+	}
+	if plan.ImportBlocksFile != "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Cannot roll back in import blocks mode",
+			Detail:   "When generating import blocks Terrafy doesn't change the Terraform state, so there is nothing to roll back.",
+		})
+	}
+	return diags
+}
+
+// beginImportTransaction saves a copy of the latest state snapshot and then
+// returns a transaction that can roll back to it. If mode is empty then
+// rollback is disabled and the result is nil.
+func beginImportTransaction(opts *Options, mode string) (*importTransaction, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if mode == "" {
+		return nil, diags
+	}
+
+	raw, _, err := pullState(context.Background(), opts.TerraformExec, opts.dir())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to back up the state",
+			Detail:   fmt.Sprintf("Could not read the latest Terraform state snapshot to back it up before importing:\n\n%s", err),
+		})
+		return nil, diags
+	}
+	tx := &importTransaction{
+		opts:     opts,
+		mode:     mode,
+		hadState: raw != nil,
+		files:    map[string]*originalFile{},
+	}
+	if raw != nil {
+		// The state might contain secrets, so only the current user should
+		// be able to read the backup.
+		tx.backupFile = filepath.Join(opts.dir(), stateBackupFile)
+		err := os.MkdirAll(filepath.Dir(tx.backupFile), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(tx.backupFile, raw, 0600)
+		}
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to back up the state",
+				Detail:   fmt.Sprintf("Could not write the state backup to %s: %s.", tx.backupFile, err),
+			})
+			return nil, diags
+		}
+	}
+	return tx, diags
+}
+
+// recordImport records that the given instance was imported into the state.
+func (tx *importTransaction) recordImport(addr resourceInstanceAddr) {
+	if tx == nil {
+		return
+	}
+	tx.imported = append(tx.imported, addr)
+}
+
+// recordFile records the current content and mode of the given file, if we
+// haven't already, before the caller modifies it.
+func (tx *importTransaction) recordFile(filename string) {
+	if tx == nil {
+		return
+	}
+	if _, exists := tx.files[filename]; exists {
+		return
+	}
+	var orig *originalFile
+	if info, err := os.Stat(filename); err == nil {
+		if src, err := ioutil.ReadFile(filename); err == nil {
+			orig = &originalFile{src: src, mode: info.Mode().Perm()}
+		}
+	}
+	tx.files[filename] = orig
+	tx.fileOrder = append(tx.fileOrder, filename)
+}
+
+// commit discards the state backup once there's nothing left that could
+// fail in a way we'd need to roll back, after which rollback does nothing.
+func (tx *importTransaction) commit() {
+	if tx == nil {
+		return
+	}
+	tx.committed = true
+	if tx.backupFile != "" {
+		os.Remove(tx.backupFile)
+		tx.backupFile = ""
+	}
+}
+
+// rollback undoes the imports and configuration changes recorded so far,
+// reporting what it undid to the given ui.
+func (tx *importTransaction) rollback(view ui) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if tx == nil || tx.committed {
+		return diags
+	}
+
+	view.RollingBack(tx.mode)
+	var restoredFiles []string
+	for _, filename := range tx.fileOrder {
+		orig := tx.files[filename]
+		var err error
+		if orig == nil {
+			err = os.Remove(filename)
+		} else {
+			// WriteFile only uses the mode when it creates the file, so we
+			// set it again in case something changed it in the meantime.
+			err = ioutil.WriteFile(filename, orig.src, orig.mode)
+			if err == nil {
+				err = os.Chmod(filename, orig.mode)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to roll back configuration",
+				Detail:   fmt.Sprintf("Could not restore the original content of %s: %s.", filename, err),
+			})
+			continue
+		}
+		restoredFiles = append(restoredFiles, filename)
+	}
+
+	var err error
+	switch {
+	case len(tx.imported) == 0:
+		// Nothing to undo in the state.
+	case tx.mode == rollbackRestore && tx.hadState:
+		var src []byte
+		src, err = ioutil.ReadFile(tx.backupFile)
+		if err == nil {
+			// The backup has an older serial than the state we're replacing,
+			// so Terraform would refuse to push it without -force.
+			_, err = runTerraform(context.Background(), tx.opts.TerraformExec, tx.opts.dir(), src, "state", "push", "-force", "-")
+		}
+	default:
+		// If there was no state at all before we started then there's no
+		// snapshot to restore, so removing what we added has the same
+		// result.
+		args := []string{"state", "rm"}
+		for _, addr := range tx.imported {
+			args = append(args, addr.String())
+		}
+		_, err = runTerraform(context.Background(), tx.opts.TerraformExec, tx.opts.dir(), nil, args...)
+	}
+	if err != nil {
+		detail := fmt.Sprintf("Could not undo the imports from this run:\n\n%s", err)
+		if tx.backupFile != "" {
+			detail += fmt.Sprintf("\n\nThe state as it was before importing is saved in %s. To restore it, run:\n    terraform state push -force %s", tx.backupFile, stateBackupFile)
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to roll back imports",
+			Detail:   detail,
+		})
+		view.RolledBack(nil, restoredFiles)
+		return diags
+	}
+
+	view.RolledBack(tx.imported, restoredFiles)
+	tx.commit()
+	return diags
+}
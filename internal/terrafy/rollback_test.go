@@ -0,0 +1,131 @@
+package terrafy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImportTransactionCommit(t *testing.T) {
+	dir := t.TempDir()
+	backupFile := filepath.Join(dir, stateBackupFile)
+	writeTestFile(t, backupFile, "{}")
+	filename := filepath.Join(dir, "main.tf")
+	writeTestFile(t, filename, "original\n")
+
+	tx := &importTransaction{
+		mode:       rollbackRestore,
+		backupFile: backupFile,
+		hadState:   true,
+		files:      map[string]*originalFile{},
+	}
+	tx.recordFile(filename)
+	writeTestFile(t, filename, "updated\n")
+	tx.commit()
+
+	if _, err := os.Stat(backupFile); !os.IsNotExist(err) {
+		t.Errorf("state backup still exists after commit")
+	}
+
+	// Rolling back after committing does nothing.
+	view := &rollbackTestUI{}
+	if diags := tx.rollback(view); len(diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %s", diags.Error())
+	}
+	if view.rollingBack {
+		t.Errorf("rollback started after commit")
+	}
+	if got := readTestFile(t, filename); got != "updated\n" {
+		t.Errorf("wrong content after commit %q", got)
+	}
+}
+
+func TestImportTransactionRollback(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "main.tf")
+	writeTestFile(t, existing, "original\n")
+	if err := os.Chmod(existing, 0600); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(dir, "generated.tf")
+
+	tx := &importTransaction{
+		mode:  rollbackRemove,
+		files: map[string]*originalFile{},
+	}
+	tx.recordFile(existing)
+	tx.recordFile(created)
+
+	// A partial write that also changed the mode, followed by a new file.
+	writeTestFile(t, existing, "orig")
+	if err := os.Chmod(existing, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, created, "resource \"test_thing\" \"a\" {}\n")
+
+	// Recording a file again keeps what it was before the first change.
+	tx.recordFile(existing)
+
+	view := &rollbackTestUI{}
+	if diags := tx.rollback(view); len(diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %s", diags.Error())
+	}
+
+	if got := readTestFile(t, existing); got != "original\n" {
+		t.Errorf("wrong restored content %q", got)
+	}
+	info, err := os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0600 {
+		t.Errorf("wrong restored mode %s; want %s", got, os.FileMode(0600))
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("new file still exists after rollback")
+	}
+	if want := []string{existing, created}; !reflect.DeepEqual(view.files, want) {
+		t.Errorf("wrong restored files\ngot:  %#v\nwant: %#v", view.files, want)
+	}
+
+	// Rolling back a second time does nothing.
+	view = &rollbackTestUI{}
+	tx.rollback(view)
+	if view.rollingBack {
+		t.Errorf("rollback started twice")
+	}
+}
+
+func TestImportTransactionNil(t *testing.T) {
+	var tx *importTransaction
+	tx.recordImport(resourceInstanceAddr{})
+	tx.recordFile(filepath.Join(t.TempDir(), "main.tf"))
+	tx.commit()
+	view := &rollbackTestUI{}
+	if diags := tx.rollback(view); len(diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %s", diags.Error())
+	}
+	if view.rollingBack {
+		t.Errorf("nil transaction started a rollback")
+	}
+}
+
+// rollbackTestUI records the rollback events. Any other call panics,
+// because it goes to the embedded nil ui.
+type rollbackTestUI struct {
+	ui
+
+	rollingBack bool
+	instances   []resourceInstanceAddr
+	files       []string
+}
+
+func (v *rollbackTestUI) RollingBack(mode string) {
+	v.rollingBack = true
+}
+
+func (v *rollbackTestUI) RolledBack(instances []resourceInstanceAddr, files []string) {
+	v.instances = instances
+	v.files = files
+}
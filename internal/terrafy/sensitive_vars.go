@@ -0,0 +1,255 @@
+package terrafy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// sensitiveValuesFile is the name of the variables file where Terrafy writes
+// the values of sensitive arguments, if the settings ask it to. Terraform
+// loads files with this suffix automatically.
+const sensitiveValuesFile = "terrafy.auto.tfvars"
+
+// generatedVariable is an input variable that generateResourceConfig declared
+// to stand in for the value of a sensitive argument.
+type generatedVariable struct {
+	Name        string
+	Description string
+
+	// Value is the value the variable must have for the resource
+	// configuration to match the imported objects.
+	Value cty.Value
+}
+
+// generateSensitiveAttribute generates an argument that refers to a new input
+// variable instead of including its sensitive value directly, and records
+// the variable in opts.Variables so that the caller can declare it.
+//
+// If the instances have different values then the variable is a collection
+// with an element per instance, which the argument looks up using the
+// current instance key.
+func generateSensitiveAttribute(addr resourceAddr, path, name string, vals map[resourceInstanceAddr]cty.Value, opts *genOptions, body *hclwrite.Body) {
+	singleVal := singleValue(vals)
+	if singleVal != cty.NilVal && singleVal.IsNull() {
+		return
+	}
+
+	varName := opts.variableName(addr, path+name)
+	varTokens := hclwrite.TokensForTraversal(hcl.Traversal{
+		hcl.TraverseRoot{Name: "var"},
+		hcl.TraverseAttr{Name: varName},
+	})
+	v := generatedVariable{
+		Name: varName,
+		// The value path includes the position or label of each enclosing
+		// block, so that the descriptions distinguish the variables for
+		// arguments in different blocks of the same type.
+		Description: fmt.Sprintf("The value for the sensitive argument %s in %s.", opts.valuePrefix+name, addr),
+		Value:       singleVal,
+	}
+
+	if singleVal == cty.NilVal {
+		v.Value = instanceKeyedValue(vals)
+		varTokens = appendIndexTokens(varTokens, instanceKeyTraversal(vals))
+	}
+
+	body.SetAttributeRaw(name, varTokens)
+	opts.Variables = append(opts.Variables, v)
+}
+
+// generateDynamicSensitiveAttribute generates an argument in the content
+// block of a dynamic block that refers to a new input variable instead of
+// including its sensitive value directly, and records the variable in
+// opts.Variables so that the caller can declare it. The for_each value of a
+// dynamic block can't be sensitive, so we can't include these values there.
+//
+// The variable has an element for each resource instance, and then for
+// each element of the for_each collections of the given dynamic scope in
+// turn, with the argument's value at the innermost level.
+func generateDynamicSensitiveAttribute(addr resourceAddr, path, name string, scope *dynamicScope, opts *genOptions, body *hclwrite.Body) {
+	vals := make(map[resourceInstanceAddr]cty.Value, len(scope.Blocks))
+	allNull := true
+	for instAddr, coll := range scope.Blocks {
+		vals[instAddr] = mapDynamicBlocks(coll, len(scope.Iterators), func(obj cty.Value) cty.Value {
+			v := obj.GetAttr(name)
+			if !v.IsNull() {
+				allNull = false
+			}
+			return v
+		})
+	}
+	if allNull {
+		return
+	}
+
+	varName := opts.variableName(addr, path+name)
+	varTokens := hclwrite.TokensForTraversal(hcl.Traversal{
+		hcl.TraverseRoot{Name: "var"},
+		hcl.TraverseAttr{Name: varName},
+	})
+	varTokens = appendIndexTokens(varTokens, instanceKeyTraversal(vals))
+	for _, iterator := range scope.Iterators {
+		varTokens = appendIndexTokens(varTokens, hcl.Traversal{
+			hcl.TraverseRoot{Name: iterator},
+			hcl.TraverseAttr{Name: "key"},
+		})
+	}
+
+	body.SetAttributeRaw(name, varTokens)
+	opts.Variables = append(opts.Variables, generatedVariable{
+		Name:        varName,
+		Description: fmt.Sprintf("The values for the sensitive argument %s in the dynamic %s blocks of %s, by instance key and then by the key of each block.", path+name, path[:len(path)-1], addr),
+		Value:       instanceKeyedValue(vals),
+	})
+}
+
+// instanceKeyedValue returns a value with an element for each of the given
+// values, which the configuration of the resource can look up using the
+// traversal from instanceKeyTraversal.
+func instanceKeyedValue(vals map[resourceInstanceAddr]cty.Value) cty.Value {
+	keys, vVals := valuesByInstanceKey(vals)
+	if _, isCount := keys[0].(int); isCount {
+		// For count we need a list with an element for every index,
+		// even if we didn't import all of them.
+		var elemTy cty.Type
+		for _, v := range vVals {
+			elemTy = v.Type()
+		}
+		highest := keys[len(keys)-1].(int)
+		elems := make([]cty.Value, highest+1)
+		for i := range elems {
+			if v, exists := vVals[i]; exists {
+				elems[i] = v
+			} else {
+				elems[i] = cty.NullVal(elemTy)
+			}
+		}
+		return cty.TupleVal(elems)
+	}
+	attrs := make(map[string]cty.Value, len(keys))
+	for _, k := range keys {
+		attrs[k.(string)] = vVals[k]
+	}
+	return cty.ObjectVal(attrs)
+}
+
+// appendIndexTokens appends an index operation using the given traversal as
+// its key to the given tokens.
+func appendIndexTokens(tokens hclwrite.Tokens, key hcl.Traversal) hclwrite.Tokens {
+	tokens = append(tokens, &hclwrite.Token{
+		Type:  hclsyntax.TokenOBrack,
+		Bytes: []byte{'['},
+	})
+	tokens = append(tokens, hclwrite.TokensForTraversal(key)...)
+	return append(tokens, &hclwrite.Token{
+		Type:  hclsyntax.TokenCBrack,
+		Bytes: []byte{']'},
+	})
+}
+
+// variableName returns a new input variable name for the argument at the
+// given path in the given resource, which doesn't conflict with any of the
+// names in opts.ReservedVariables, and then reserves it.
+func (o *genOptions) variableName(addr resourceAddr, path string) string {
+	base := fmt.Sprintf("%s_%s_%s", addr.Type, addr.Name, strings.Replace(path, ".", "_", -1))
+	name := base
+	for i := 2; o.ReservedVariables[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	o.ReservedVariables[name] = true
+	return name
+}
+
+// declaredVariables returns the names of the input variables declared in
+// the module in the given directory.
+func declaredVariables(dir string) []string {
+	var ret []string
+	for _, block := range moduleBlocks(dir, variableDeclsSchema) {
+		ret = append(ret, block.Labels[0])
+	}
+	return ret
+}
+
+var variableDeclsSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variable", LabelNames: []string{"name"}},
+	},
+}
+
+// appendVariableBlock appends a declaration of the given variable to the
+// given body.
+func appendVariableBlock(body *hclwrite.Body, v generatedVariable) {
+	block := body.AppendNewBlock("variable", []string{v.Name})
+	block.Body().SetAttributeValue("description", cty.StringVal(v.Description))
+	block.Body().SetAttributeValue("sensitive", cty.True)
+}
+
+// writeSensitiveValues adds the values of the given variables to the
+// sensitive values file in the given directory, and makes sure that git
+// will ignore that file so that it won't be committed by mistake.
+func writeSensitiveValues(dir string, vars []generatedVariable) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	filename := filepath.Join(dir, sensitiveValuesFile)
+	var oldSrc []byte
+	if src, err := ioutil.ReadFile(filename); err == nil {
+		oldSrc = src
+	}
+	f, moreDiags := hclwrite.ParseConfig(oldSrc, filename, hcl.InitialPos)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return diags
+	}
+	for _, v := range vars {
+		f.Body().SetAttributeValue(v.Name, v.Value)
+	}
+
+	// This file contains secrets, so only the current user should be able
+	// to read it.
+	if err := ioutil.WriteFile(filename, f.Bytes(), 0600); err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to write sensitive values",
+			Detail:   fmt.Sprintf("Could not write the values of the sensitive arguments to %s: %s.", filename, err),
+		})
+		return diags
+	}
+
+	ignoreFilename := filepath.Join(dir, ".gitignore")
+	ignoreSrc, err := ioutil.ReadFile(ignoreFilename)
+	if err != nil && !os.IsNotExist(err) {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Failed to read .gitignore",
+			Detail:   fmt.Sprintf("Could not read %s to make sure that it ignores %s: %s. Make sure not to commit the sensitive values to version control.", ignoreFilename, sensitiveValuesFile, err),
+		})
+		return diags
+	}
+	for _, line := range strings.Split(string(ignoreSrc), "\n") {
+		line = strings.TrimSpace(line)
+		if line == sensitiveValuesFile || line == "/"+sensitiveValuesFile || line == "*.tfvars" || line == "*.auto.tfvars" {
+			return diags
+		}
+	}
+	if len(ignoreSrc) != 0 && !bytes.HasSuffix(ignoreSrc, []byte{'\n'}) {
+		ignoreSrc = append(ignoreSrc, '\n')
+	}
+	ignoreSrc = append(ignoreSrc, "/"+sensitiveValuesFile+"\n"...)
+	if err := ioutil.WriteFile(ignoreFilename, ignoreSrc, 0644); err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Failed to update .gitignore",
+			Detail:   fmt.Sprintf("Could not add %s to %s: %s. Make sure not to commit the sensitive values to version control.", sensitiveValuesFile, ignoreFilename, err),
+		})
+	}
+	return diags
+}
@@ -0,0 +1,307 @@
+package terrafy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestVariableName(t *testing.T) {
+	addr := resourceAddr{
+		Mode: tfjson.ManagedResourceMode,
+		Type: "test_thing",
+		Name: "a",
+	}
+	tests := map[string]struct {
+		reserved []string
+		paths    []string
+		want     []string
+	}{
+		"argument": {
+			paths: []string{"password"},
+			want:  []string{"test_thing_a_password"},
+		},
+		"nested argument": {
+			paths: []string{"rule.password"},
+			want:  []string{"test_thing_a_rule_password"},
+		},
+		"repeated": {
+			paths: []string{"rule.password", "rule.password", "rule.password"},
+			want:  []string{"test_thing_a_rule_password", "test_thing_a_rule_password_2", "test_thing_a_rule_password_3"},
+		},
+		"already declared": {
+			reserved: []string{"test_thing_a_password", "test_thing_a_password_2"},
+			paths:    []string{"password"},
+			want:     []string{"test_thing_a_password_3"},
+		},
+		"same name from different paths": {
+			paths: []string{"rule_password", "rule.password"},
+			want:  []string{"test_thing_a_rule_password", "test_thing_a_rule_password_2"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := &genOptions{ReservedVariables: map[string]bool{}}
+			for _, name := range test.reserved {
+				opts.ReservedVariables[name] = true
+			}
+			for i, path := range test.paths {
+				if got := opts.variableName(addr, path); got != test.want[i] {
+					t.Errorf("wrong name for %s %d\ngot:  %s\nwant: %s", path, i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSensitiveArguments(t *testing.T) {
+	schema := &tfjson.SchemaBlock{
+		Attributes: map[string]*tfjson.SchemaAttribute{
+			"password": {AttributeType: cty.String, Optional: true, Sensitive: true},
+		},
+		NestedBlocks: map[string]*tfjson.SchemaBlockType{
+			"rule": {
+				NestingMode: tfjson.SchemaNestingModeList,
+				Block: &tfjson.SchemaBlock{
+					Attributes: map[string]*tfjson.SchemaAttribute{
+						"port":   {AttributeType: cty.Number, Optional: true},
+						"secret": {AttributeType: cty.String, Optional: true, Sensitive: true},
+					},
+				},
+			},
+		},
+	}
+	ruleTy := cty.Object(map[string]cty.Type{"port": cty.Number, "secret": cty.String})
+	obj := func(password string, secrets ...string) cty.Value {
+		rules := cty.ListValEmpty(ruleTy)
+		if len(secrets) != 0 {
+			elems := make([]cty.Value, len(secrets))
+			for i, secret := range secrets {
+				elems[i] = cty.ObjectVal(map[string]cty.Value{
+					"port":   cty.NumberIntVal(int64(80 + i)),
+					"secret": cty.StringVal(secret),
+				})
+			}
+			rules = cty.ListVal(elems)
+		}
+		return cty.ObjectVal(map[string]cty.Value{
+			"password": cty.StringVal(password),
+			"rule":     rules,
+		})
+	}
+
+	tests := map[string]struct {
+		vals      []cty.Value // by count.index
+		wantArgs  []string
+		wantVars  []generatedVariable
+		wantNoArg string
+	}{
+		"same value": {
+			vals: []cty.Value{obj("p"), obj("p")},
+			wantArgs: []string{
+				"password = var.test_thing_a_password\n",
+			},
+			wantVars: []generatedVariable{
+				{
+					Name:        "test_thing_a_password",
+					Description: "The value for the sensitive argument password in test_thing.a.",
+					Value:       cty.StringVal("p"),
+				},
+			},
+		},
+		"different values": {
+			vals: []cty.Value{obj("p0"), obj("p1")},
+			wantArgs: []string{
+				"password = var.test_thing_a_password[count.index]\n",
+			},
+			wantVars: []generatedVariable{
+				{
+					Name:        "test_thing_a_password",
+					Description: "The value for the sensitive argument password in test_thing.a.",
+					Value:       cty.TupleVal([]cty.Value{cty.StringVal("p0"), cty.StringVal("p1")}),
+				},
+			},
+		},
+		"repeated nested blocks": {
+			vals: []cty.Value{obj("p", "s0", "s1"), obj("p", "s0", "s1")},
+			wantArgs: []string{
+				"secret = var.test_thing_a_rule_secret\n",
+				"secret = var.test_thing_a_rule_secret_2\n",
+			},
+			wantVars: []generatedVariable{
+				{
+					Name:        "test_thing_a_password",
+					Description: "The value for the sensitive argument password in test_thing.a.",
+					Value:       cty.StringVal("p"),
+				},
+				{
+					Name:        "test_thing_a_rule_secret",
+					Description: "The value for the sensitive argument rule[0].secret in test_thing.a.",
+					Value:       cty.StringVal("s0"),
+				},
+				{
+					Name:        "test_thing_a_rule_secret_2",
+					Description: "The value for the sensitive argument rule[1].secret in test_thing.a.",
+					Value:       cty.StringVal("s1"),
+				},
+			},
+		},
+		"dynamic blocks": {
+			vals: []cty.Value{obj("p", "s0"), obj("p", "t0", "t1")},
+			wantArgs: []string{
+				"secret = var.test_thing_a_rule_secret[count.index][rule.key]\n",
+			},
+			wantVars: []generatedVariable{
+				{
+					Name:        "test_thing_a_password",
+					Description: "The value for the sensitive argument password in test_thing.a.",
+					Value:       cty.StringVal("p"),
+				},
+				{
+					Name:        "test_thing_a_rule_secret",
+					Description: "The values for the sensitive argument rule.secret in the dynamic rule blocks of test_thing.a, by instance key and then by the key of each block.",
+					Value: cty.TupleVal([]cty.Value{
+						cty.TupleVal([]cty.Value{cty.StringVal("s0")}),
+						cty.TupleVal([]cty.Value{cty.StringVal("t0"), cty.StringVal("t1")}),
+					}),
+				},
+			},
+			wantNoArg: "IMPORT-TODO",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr := resourceAddr{
+				Mode: tfjson.ManagedResourceMode,
+				Type: "test_thing",
+				Name: "a",
+			}
+			vals := make(map[resourceInstanceAddr]cty.Value, len(test.vals))
+			for i, v := range test.vals {
+				vals[resourceInstanceAddr{Resource: addr, InstanceKey: i}] = v
+			}
+			opts := newGenOptions(&Settings{}, addr, "registry.terraform.io/hashicorp/test")
+
+			f := hclwrite.NewEmptyFile()
+			diags := generateConfigBody(addr, "", vals, schema, opts, f.Body())
+			if len(diags) != 0 {
+				t.Fatalf("unexpected diagnostics: %s", diags.Error())
+			}
+			got := string(hclwrite.Format(f.Bytes()))
+			for _, want := range test.wantArgs {
+				if !strings.Contains(got, want) {
+					t.Errorf("missing %q in\n%s", want, got)
+				}
+			}
+			if test.wantNoArg != "" && strings.Contains(got, test.wantNoArg) {
+				t.Errorf("unexpected %q in\n%s", test.wantNoArg, got)
+			}
+
+			if len(opts.Variables) != len(test.wantVars) {
+				t.Fatalf("wrong number of variables %d; want %d\n%#v", len(opts.Variables), len(test.wantVars), opts.Variables)
+			}
+			for i, want := range test.wantVars {
+				got := opts.Variables[i]
+				if got.Name != want.Name || got.Description != want.Description || !got.Value.RawEquals(want.Value) {
+					t.Errorf("wrong variable %d\ngot:  %#v\nwant: %#v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteSensitiveValues(t *testing.T) {
+	vars := []generatedVariable{
+		{Name: "test_thing_a_password", Value: cty.StringVal("hunter2")},
+	}
+	tests := map[string]struct {
+		tfvars, gitignore         string
+		wantTFVars, wantGitignore string
+	}{
+		"new files": {
+			wantTFVars:    "test_thing_a_password = \"hunter2\"\n",
+			wantGitignore: "/terrafy.auto.tfvars\n",
+		},
+		"existing files": {
+			tfvars:        "other = 1\n",
+			gitignore:     "*.tfstate",
+			wantTFVars:    "other                 = 1\ntest_thing_a_password = \"hunter2\"\n",
+			wantGitignore: "*.tfstate\n/terrafy.auto.tfvars\n",
+		},
+		"replacing a value": {
+			tfvars:        "test_thing_a_password = \"old\"\n",
+			gitignore:     "/terrafy.auto.tfvars\n",
+			wantTFVars:    "test_thing_a_password = \"hunter2\"\n",
+			wantGitignore: "/terrafy.auto.tfvars\n",
+		},
+		"already ignored by pattern": {
+			gitignore:     ".terraform\n*.auto.tfvars\n",
+			wantTFVars:    "test_thing_a_password = \"hunter2\"\n",
+			wantGitignore: ".terraform\n*.auto.tfvars\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			tfvarsFilename := filepath.Join(dir, sensitiveValuesFile)
+			gitignoreFilename := filepath.Join(dir, ".gitignore")
+			if test.tfvars != "" {
+				writeTestFile(t, tfvarsFilename, test.tfvars)
+			}
+			if test.gitignore != "" {
+				writeTestFile(t, gitignoreFilename, test.gitignore)
+			}
+
+			diags := writeSensitiveValues(dir, vars)
+			if len(diags) != 0 {
+				t.Fatalf("unexpected diagnostics: %s", diags.Error())
+			}
+
+			if got := readTestFile(t, tfvarsFilename); string(hclwrite.Format([]byte(got))) != test.wantTFVars {
+				t.Errorf("wrong %s\ngot:\n%s\nwant:\n%s", sensitiveValuesFile, got, test.wantTFVars)
+			}
+			if got := readTestFile(t, gitignoreFilename); got != test.wantGitignore {
+				t.Errorf("wrong .gitignore\ngot:\n%s\nwant:\n%s", got, test.wantGitignore)
+			}
+			info, err := os.Stat(tfvarsFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.tfvars == "" && info.Mode().Perm() != 0600 {
+				t.Errorf("wrong permissions %s; want only the owner to be able to read it", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestWriteSensitiveValuesInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, sensitiveValuesFile), "not valid {")
+	diags := writeSensitiveValues(dir, []generatedVariable{
+		{Name: "a", Value: cty.StringVal("b")},
+	})
+	if !diags.HasErrors() {
+		t.Fatal("unexpected success")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gitignore")); !os.IsNotExist(err) {
+		t.Errorf("unexpected .gitignore")
+	}
+}
+
+func readTestFile(t *testing.T, filename string) string {
+	t.Helper()
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(src)
+}
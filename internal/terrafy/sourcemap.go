@@ -0,0 +1,129 @@
+package terrafy
+
+import (
+	"bytes"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// prepFileBuilder builds up the source code of a file in the temporary
+// configuration while recording which parts of it were copied verbatim from
+// the Terrafy configuration, so that we can later translate source locations
+// in the generated file back to the original files.
+type prepFileBuilder struct {
+	buf      bytes.Buffer
+	segments []sourceMapSegment
+}
+
+// sourceMapSegment represents a sequence of bytes in a generated file that
+// was copied verbatim from an original source file.
+type sourceMapSegment struct {
+	// GenStart and GenEnd are the byte offsets of the segment in the
+	// generated file.
+	GenStart, GenEnd int
+
+	// Filename and SrcStart identify the start of the same bytes in the
+	// original source file.
+	Filename string
+	SrcStart int
+}
+
+// WriteString appends some generated source code that did not come from
+// any of the original files.
+func (b *prepFileBuilder) WriteString(s string) {
+	b.buf.WriteString(s)
+}
+
+// WriteSource appends the bytes covered by the given range in the given
+// source file, recording where they came from.
+func (b *prepFileBuilder) WriteSource(rng hcl.Range, file *hcl.File) {
+	b.WriteSourceBytes(rng.SliceBytes(file.Bytes), rng.Filename, rng.Start.Byte)
+}
+
+// WriteSourceBytes appends the given bytes, which must have been copied
+// verbatim from the given byte offset in the given source file.
+func (b *prepFileBuilder) WriteSourceBytes(src []byte, filename string, srcStart int) {
+	start := b.buf.Len()
+	b.buf.Write(src)
+	b.segments = append(b.segments, sourceMapSegment{
+		GenStart: start,
+		GenEnd:   b.buf.Len(),
+		Filename: filename,
+		SrcStart: srcStart,
+	})
+}
+
+// Bytes returns the generated source code built so far.
+func (b *prepFileBuilder) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// sourceMap records the origins of the verbatim-copied parts of all of the
+// files in a temporary configuration, keyed by the base name of each
+// generated file.
+type sourceMap struct {
+	files   map[string][]sourceMapSegment
+	sources map[string]*hcl.File
+}
+
+func newSourceMap(sources map[string]*hcl.File) *sourceMap {
+	return &sourceMap{
+		files:   make(map[string][]sourceMapSegment),
+		sources: sources,
+	}
+}
+
+// AddFile records the segments of the given builder as belonging to the
+// generated file with the given name.
+func (m *sourceMap) AddFile(filename string, b *prepFileBuilder) {
+	m.files[filepath.Base(filename)] = b.segments
+}
+
+// Translate attempts to find the location in an original source file that
+// corresponds with the given range in a generated file. It returns false if
+// the given range doesn't start in a part of the generated file that was
+// copied from an original file.
+func (m *sourceMap) Translate(rng hcl.Range) (hcl.Range, bool) {
+	for _, seg := range m.files[filepath.Base(rng.Filename)] {
+		if rng.Start.Byte < seg.GenStart || rng.Start.Byte > seg.GenEnd {
+			continue
+		}
+		file := m.sources[seg.Filename]
+		if file == nil {
+			return rng, false
+		}
+
+		endByte := rng.End.Byte
+		if endByte > seg.GenEnd || endByte < rng.Start.Byte {
+			// The range extends beyond what we copied, so we'll just
+			// truncate it to the part that we did copy.
+			endByte = seg.GenEnd
+		}
+		startOffset := seg.SrcStart + (rng.Start.Byte - seg.GenStart)
+		endOffset := seg.SrcStart + (endByte - seg.GenStart)
+		return hcl.Range{
+			Filename: seg.Filename,
+			Start:    sourcePos(file.Bytes, startOffset),
+			End:      sourcePos(file.Bytes, endOffset),
+		}, true
+	}
+	return rng, false
+}
+
+// sourcePos calculates the line and column of the given byte offset into
+// the given source code.
+func sourcePos(src []byte, offset int) hcl.Pos {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	before := src[:offset]
+	line := 1 + bytes.Count(before, []byte{'\n'})
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return hcl.Pos{
+		Line:   line,
+		Column: 1 + utf8.RuneCount(before[lineStart:]),
+		Byte:   offset,
+	}
+}
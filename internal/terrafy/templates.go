@@ -0,0 +1,47 @@
+package terrafy
+
+import (
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+)
+
+// templateNames returns the names of the arguments and the types of the
+// nested blocks that the given generate block template sets directly, which
+// Terrafy must therefore not generate itself.
+func templateNames(src string) map[string]bool {
+	ret := map[string]bool{}
+	if src == "" {
+		return ret
+	}
+	f, diags := hclwrite.ParseConfig([]byte(src), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		// Should never happen, because we parsed this same source code as
+		// part of its .tfy file.
+		return ret
+	}
+	for name := range f.Body().Attributes() {
+		ret[name] = true
+	}
+	for _, block := range f.Body().Blocks() {
+		ret[block.Type()] = true
+	}
+	return ret
+}
+
+// appendTemplate appends the content of the given generate block template to
+// the body of a generated resource block, after a blank line to separate it
+// from the generated arguments.
+func appendTemplate(body *hclwrite.Body, src string) hcl.Diagnostics {
+	if src == "" {
+		return nil
+	}
+	f, diags := hclwrite.ParseConfig([]byte(src+"\n"), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return diags
+	}
+	if len(body.Attributes()) != 0 || len(body.Blocks()) != 0 {
+		body.AppendNewline()
+	}
+	body.AppendUnstructuredTokens(f.Body().BuildTokens(nil))
+	return diags
+}
@@ -2,7 +2,9 @@ package terrafy
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -17,39 +19,274 @@ import (
 	"github.com/hashicorp/terraform-exec/tfexec"
 	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Options represents execution options that are customizable from the
 // command line.
 type Options struct {
+	// TerraformExec is the path to the Terraform CLI executable that
+	// Terrafy will run to do most of its work.
 	TerraformExec string
+
+	// Dir is the directory containing the Terraform and Terrafy configuration
+	// files to work with. If empty, the current working directory is used.
+	Dir string
+
+	// NoColor disables the use of terminal formatting sequences in any
+	// output produced on behalf of Terrafy.
+	NoColor bool
+
+	// AutoApprove skips the interactive confirmation prompt in Apply, so
+	// that the import plan is carried out immediately.
+	AutoApprove bool
+
+	// PlanOut, if set, is a filename where Plan will save the import plan
+	// so that it can be reviewed and then applied later.
+	PlanOut string
+
+	// PlanFile, if set, is the filename of a plan previously saved by Plan,
+	// which Apply will then carry out instead of creating a new plan.
+	PlanFile string
+
+	// JSON selects machine-readable output, where Terrafy describes its
+	// work as a stream of JSON objects, one per line.
+	JSON bool
+
+	// ImportBlocks selects an alternative mode where, instead of importing
+	// directly into the state, Terrafy generates import blocks for
+	// Terraform v1.5 and later, leaving the actual import to a normal
+	// Terraform plan and apply.
+	ImportBlocks bool
+
+	// Rollback, if set, makes Apply undo the imports and configuration
+	// changes it already made if a later step fails, either by removing the
+	// imported instances from the state (rollbackRemove) or by restoring a
+	// backup of the state taken before starting (rollbackRestore).
+	Rollback string
+
+	// Resume makes Apply continue an earlier apply that didn't complete,
+	// using the plan and progress recorded in its journal file, instead of
+	// creating a new plan.
+	Resume bool
+
+	// Minimize enables an extra step after generating each resource block,
+	// where Terrafy tries removing each optional argument in turn and keeps
+	// the removal only if Terraform would still plan no changes.
+	Minimize bool
+
+	// Vars and VarFiles set values for the input variables declared in the
+	// .tfy files, using the same syntax as Terraform's own -var and
+	// -var-file options. Relative VarFiles paths are relative to Dir.
+	Vars     []string
+	VarFiles []string
+}
+
+func (opts *Options) dir() string {
+	if opts.Dir == "" {
+		return "."
+	}
+	return opts.Dir
 }
 
-// Run is the main entrypoint.
+// Validate loads the Terrafy configuration and reports any problems with it,
+// without running Terraform at all.
 //
 // It returns a map of the source code of any files it used as part of its
 // work, along with any diagnostics.
-func Run(opts *Options) (map[string]*hcl.File, hcl.Diagnostics) {
-	var diags hcl.Diagnostics
+func Validate(opts *Options) (map[string]*hcl.File, hcl.Diagnostics) {
+	view := newUI(opts)
+	cfg, diags := LoadConfig(opts.dir())
+	if diags.HasErrors() {
+		return cfg.SourceFiles, diags
+	}
 
-	cfg, moreDiags := LoadConfig(".")
+	if len(cfg.ImportConfigs) == 0 {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "No import blocks",
+			Detail:   fmt.Sprintf("There are no import blocks in the .tfy files in %s, so Terrafy would have nothing to do.", opts.dir()),
+		})
+	}
+
+	view.Valid()
+	return cfg.SourceFiles, diags
+}
+
+// Plan determines which remote objects need to be imported and which
+// resource blocks need to be generated, and describes those actions without
+// taking them. If opts.PlanOut is set, it also saves the plan to that file
+// so that it can be applied later.
+//
+// It returns a map of the source code of any files it used as part of its
+// work, along with any diagnostics.
+func Plan(opts *Options) (map[string]*hcl.File, hcl.Diagnostics) {
+	view := newUI(opts)
+	prep, diags := newPrepDir(opts)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	defer prep.Close()
+
+	cfg, plan, _, moreDiags := makePlan(opts, prep)
 	diags = append(diags, moreDiags...)
-	if moreDiags.HasErrors() {
+	if diags.HasErrors() {
 		return cfg.SourceFiles, diags
 	}
 
-	tmpDir, err := ioutil.TempDir("", "terrafy-")
-	if err != nil {
+	if plan.Empty() {
+		view.NothingToDo()
+	} else {
+		view.Plan(plan)
+	}
+
+	if opts.PlanOut != "" {
+		err := writePlanFile(opts.PlanOut, plan, opts.dir())
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to save plan",
+				Detail:   fmt.Sprintf("Could not write the import plan to %s: %s.", opts.PlanOut, err),
+			})
+			return cfg.SourceFiles, diags
+		}
+		view.PlanSaved(opts.PlanOut)
+	}
+
+	return cfg.SourceFiles, diags
+}
+
+// Apply is the main entrypoint. It creates an import plan in the same way as
+// Plan, and then asks for confirmation before carrying it out.
+//
+// If opts.PlanFile is set then Apply instead carries out the plan previously
+// saved in that file, without asking for confirmation, as long as the
+// configuration and state haven't changed since the plan was created.
+//
+// It returns a map of the source code of any files it used as part of its
+// work, along with any diagnostics.
+func Apply(opts *Options) (map[string]*hcl.File, hcl.Diagnostics) {
+	view := newUI(opts)
+
+	// We keep our temporary working directory around until we're finished
+	// because we might need to use it again to generate import blocks.
+	prep, diags := newPrepDir(opts)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	defer prep.Close()
+
+	if opts.Resume && (opts.PlanFile != "" || opts.Rollback != "") {
+		// Rolling back a resumed apply would undo only the steps from this
+		// run, leaving the earlier ones in place.
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to create temporary directory",
-			Detail:   fmt.Sprintf("Could not create a temporary working directory: %s.", err),
+			Summary:  "Incompatible options",
+			Detail:   "The -resume option continues the plan recorded by an earlier apply, so it can't be used with a saved plan file or with the -rollback option.",
 		})
+		return nil, diags
+	}
+
+	var cfg *Config
+	var plan *importPlan
+	var schemas *tfjson.ProviderSchemas
+	var moreDiags hcl.Diagnostics
+	switch {
+	case opts.PlanFile != "":
+		cfg, plan, schemas, moreDiags = loadSavedPlan(opts, prep)
+	case opts.Resume:
+		cfg, plan, schemas, moreDiags = loadJournalPlan(opts, prep, view)
+	default:
+		cfg, plan, schemas, moreDiags = makePlan(opts, prep)
+	}
+	diags = append(diags, moreDiags...)
+	if diags.HasErrors() {
+		return cfg.SourceFiles, diags
+	}
+
+	if plan.Empty() {
+		if opts.Resume {
+			// The earlier apply must've completed everything but then failed
+			// to remove its journal, so there's nothing left to resume.
+			diags = append(diags, (&importJournal{filename: journalFilename(opts)}).remove()...)
+		}
+		view.NothingToDo()
 		return cfg.SourceFiles, diags
 	}
-	defer os.RemoveAll(tmpDir)
 
-	tf, err := tfexec.NewTerraform(tmpDir, opts.TerraformExec)
+	if !opts.Resume && plan.ImportBlocksFile == "" {
+		moreDiags := checkNoJournal(opts)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return cfg.SourceFiles, diags
+		}
+	}
+
+	if opts.Minimize {
+		// We check this before asking for confirmation so that the user
+		// won't be surprised by a failure after importing.
+		moreDiags := checkMinimizeSupport(plan, prep.TF)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return cfg.SourceFiles, diags
+		}
+	}
+
+	if opts.Rollback != "" {
+		moreDiags := checkRollbackSupport(plan, opts.Rollback)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return cfg.SourceFiles, diags
+		}
+	}
+
+	view.Plan(plan)
+
+	// A saved plan was presumably already reviewed, so we don't ask again,
+	// and likewise for the rest of a plan that we're resuming.
+	if !opts.AutoApprove && opts.PlanFile == "" && !opts.Resume {
+		if opts.JSON {
+			// The JSON output is for consumption by other software, and
+			// so there's nobody to answer a prompt.
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Confirmation required",
+				Detail:   "Terrafy can't prompt for confirmation when producing JSON output.\n\nUse the -auto-approve option, or apply a previously-saved plan.",
+			})
+			return cfg.SourceFiles, diags
+		}
+
+		// If stdin isn't a terminal then there's nobody there to answer
+		// our question, and so we'd either block forever or read whatever
+		// garbage happens to be piped in. Better to just fail early.
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Confirmation required",
+				Detail:   "Terrafy requires confirmation before importing, but it isn't running in an interactive terminal.\n\nTo proceed without confirmation, such as in an automated pipeline, use the -auto-approve option.",
+			})
+			return cfg.SourceFiles, diags
+		}
+
+		fmt.Printf("\nDo you want to proceed? (Only \"yes\" will be accepted to confirm.)\n> ")
+		termR := bufio.NewReader(os.Stdin)
+		answer, err := termR.ReadString('\n')
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read confirmation",
+				Detail:   fmt.Sprintf("Error reading the confirmation response: %s.", err),
+			})
+			return cfg.SourceFiles, diags
+		}
+		answer = strings.TrimSpace(answer)
+		if answer != "yes" {
+			view.Cancelled()
+			return cfg.SourceFiles, diags
+		}
+	}
+
+	tf, err := tfexec.NewTerraform(opts.dir(), opts.TerraformExec)
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
@@ -59,334 +296,896 @@ func Run(opts *Options) (map[string]*hcl.File, hcl.Diagnostics) {
 		return cfg.SourceFiles, diags
 	}
 
-	// First we need to get all of the required providers installed, so we can
-	// read their schemas in preparation for our later work.
-	moreDiags = generateProviderRequirements(tmpDir, cfg.ProviderReqs, cfg.SourceFiles)
+	tx, moreDiags := beginImportTransaction(opts, opts.Rollback)
 	diags = append(diags, moreDiags...)
 	if moreDiags.HasErrors() {
-		// If we couldn't generate the requirements file then the rest of
-		// this will not succeed either.
 		return cfg.SourceFiles, diags
 	}
 
-	err = tf.Init(context.Background())
-	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{
-			Severity: hcl.DiagError,
-			Summary:  "Failed to initialize temporary working directory",
-			Detail:   fmt.Sprintf("Could not initialize a temporary working directory to handle the import:\n\n%s", err),
-		})
+	var jnl *importJournal
+	if opts.Resume {
+		jnl, moreDiags = resumeImportJournal(opts)
+	} else {
+		jnl, moreDiags = startImportJournal(opts, plan)
+	}
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
 		return cfg.SourceFiles, diags
 	}
+	defer jnl.close()
 
-	schemas, err := tf.ProvidersSchema(context.Background())
-	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{
-			Severity: hcl.DiagError,
-			Summary:  "Failed to retrieve provider schemas",
-			Detail:   fmt.Sprintf("Could not retrieve the schemas for the required providers:\n\n%s", err),
-		})
-		return cfg.SourceFiles, diags
+	moreDiags = applyImporting(opts, cfg, plan, tf, prep, schemas, tx, jnl, view)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() && tx != nil {
+		moreDiags = tx.rollback(view)
+		diags = append(diags, moreDiags...)
+		if !moreDiags.HasErrors() {
+			// There's nothing left to resume once we've undone everything.
+			diags = append(diags, jnl.remove()...)
+		}
+	}
+
+	return cfg.SourceFiles, diags
+}
+
+// makePlan does all of the preparation work that is common to both Plan and
+// Apply, producing an import plan.
+func makePlan(opts *Options, prep *prepDir) (*Config, *importPlan, *tfjson.ProviderSchemas, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	cfg, moreDiags := LoadConfig(opts.dir())
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
+	}
+
+	schemas, moreDiags := fetchSchemas(prep, cfg)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
 	}
 
 	// Now we'll generate the rest of our temporary Terraform configuration
 	// to prepare the data (from the data resources) we need to complete the
 	// import.
 	// Note that this now overwrites the stub provider configurations we
-	// generated above just to prompt Terraform to produce the schemas,
-	// now to include the actual configuration provided by the user just
-	// in case the data resources need them.
-	moreDiags = generatePrepConfig(tmpDir, cfg)
+	// generated in fetchSchemas just to prompt Terraform to produce the
+	// schemas, now to include the actual configuration provided by the user
+	// just in case the data resources need them.
+	sm, moreDiags := generatePrepConfig(prep.Dir, cfg)
 	diags = append(diags, moreDiags...)
 	if moreDiags.HasErrors() {
-		return cfg.SourceFiles, diags
+		return cfg, nil, nil, diags
 	}
 
-	err = tf.Apply(context.Background())
-	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{
-			Severity: hcl.DiagError,
-			Summary:  "Failed to read data resources",
-			Detail:   fmt.Sprintf("Could not read the defined data resources to prepare for import:\n\n%s", err),
-		})
-		return cfg.SourceFiles, diags
+	moreDiags = applyPrepConfig(opts, prep, sm)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
 	}
 
-	state, err := tf.Show(context.Background())
+	state, err := prep.TF.Show(context.Background())
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
 			Summary:  "Failed to read data results",
 			Detail:   fmt.Sprintf("Could not read the data resource results:\n\n%s", err),
 		})
-		return cfg.SourceFiles, diags
+		return cfg, nil, nil, diags
 	}
 	idsRaw := state.Values.Outputs["ids"].Value.(map[string]interface{})
+	if jsonIDs, ok := state.Values.Outputs[prepJSONIDsOutput]; ok {
+		for addr, ids := range jsonIDs.Value.(map[string]interface{}) {
+			idsRaw[addr] = ids
+		}
+	}
 
 	// We've now completed our work with the temporary directory: we've read all
 	// of the data resources and evaluated all of the "id" arguments in the
 	// import blocks. The rest of our work will be with the main configuration
 	// in the directory where we were run.
-	tf, err = tfexec.NewTerraform(".", opts.TerraformExec)
+	tf, err := tfexec.NewTerraform(opts.dir(), opts.TerraformExec)
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
 			Summary:  "Failed to initialize Terraform CLI",
 			Detail:   fmt.Sprintf("Terraform executable at %s is malfunctioning or not available: %s.", opts.TerraformExec, err),
 		})
-		return cfg.SourceFiles, diags
+		return cfg, nil, nil, diags
+	}
+	if opts.ImportBlocks {
+		moreDiags := checkImportBlocksSupport(tf)
+		moreDiags = append(moreDiags, checkImportBlocksModules(cfg)...)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return cfg, nil, nil, diags
+		}
+	}
+
+	// We record the identity of the state snapshot we're planning against
+	// so that a saved plan can be rejected if the state changes before
+	// it's applied.
+	_, currentState, err := pullState(context.Background(), opts.TerraformExec, opts.dir())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read current state",
+			Detail:   fmt.Sprintf("Could not read the latest state snapshot for this configuration:\n\n%s", err),
+		})
+		return cfg, nil, nil, diags
 	}
 
 	// Now our task is to visit each of the resource instances the user
 	// declared to import and see whether each one is already accounted for
 	// in the state (if not, we'll import it) and in the configuration
 	// (if not, we'll generate it from what's in the state).
-	plan, moreDiags := planImporting(cfg, idsRaw, tf)
+	plan, moreDiags := planImporting(cfg, idsRaw, tf, opts.dir())
 	diags = append(diags, moreDiags...)
 	if diags.HasErrors() {
-		return cfg.SourceFiles, diags
+		return cfg, nil, nil, diags
 	}
-
-	if len(plan.ToState) == 0 && len(plan.ToConfig) == 0 {
-		fmt.Printf("Nothing to do! Everything in your terrafy configuration is already known to Terraform.\n\n")
-		return cfg.SourceFiles, diags
+	plan.IDs = idsRaw
+	plan.SourcesFingerprint = sourcesFingerprint(cfg.SourceFiles, opts.dir())
+	plan.State = currentState
+	if opts.ImportBlocks {
+		plan.ImportBlocksFile = filepath.Join(opts.dir(), importBlocksFilename)
 	}
 
 	plan.Sort()
-	fmt.Printf("Import plan:\n")
-	for _, planItem := range plan.ToState {
-		fmt.Printf("- Create Terraform state binding from %s to remote object %q\n", planItem.Target, planItem.ID)
+	return cfg, plan, schemas, diags
+}
+
+// loadSavedPlan is the equivalent of makePlan for applying a plan that was
+// previously saved by Plan. It returns error diagnostics if the configuration
+// or state have changed since the plan was created.
+func loadSavedPlan(opts *Options, prep *prepDir) (*Config, *importPlan, *tfjson.ProviderSchemas, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	cfg, moreDiags := LoadConfig(opts.dir())
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
 	}
-	for _, planItem := range plan.ToConfig {
-		fmt.Printf("- Generate a new %s configuration block in %s\n", planItem.Target, planItem.Filename)
+
+	plan, err := readPlanFile(opts.PlanFile, opts.dir())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read saved plan",
+			Detail:   fmt.Sprintf("Could not read the import plan from %s: %s.", opts.PlanFile, err),
+		})
+		return cfg, nil, nil, diags
+	}
+
+	if got, want := sourcesFingerprint(cfg.SourceFiles, opts.dir()), plan.SourcesFingerprint; got != want {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Saved plan is stale",
+			Detail:   fmt.Sprintf("The configuration files in %s have changed since the plan in %s was created, so it can no longer be applied.\n\nCreate a new plan with \"terrafy plan\" and try again.", opts.dir(), opts.PlanFile),
+		})
+		return cfg, nil, nil, diags
+	}
+
+	_, currentState, err := pullState(context.Background(), opts.TerraformExec, opts.dir())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read current state",
+			Detail:   fmt.Sprintf("Could not read the latest state snapshot for this configuration:\n\n%s", err),
+		})
+		return cfg, nil, nil, diags
+	}
+	if currentState != plan.State {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Saved plan is stale",
+			Detail:   fmt.Sprintf("The Terraform state has changed since the plan in %s was created, so it can no longer be applied.\n\nCreate a new plan with \"terrafy plan\" and try again.", opts.PlanFile),
+		})
+		return cfg, nil, nil, diags
+	}
+
+	// We still need the provider schemas in order to generate configuration,
+	// but we don't need to read any data resources this time.
+	schemas, moreDiags := fetchSchemas(prep, cfg)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
+	}
+
+	if plan.ImportBlocksFile != "" {
+		// When generating import blocks we'll be importing into the
+		// temporary working directory, so it needs the real provider
+		// configurations.
+		_, moreDiags = generatePrepConfig(prep.Dir, cfg)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return cfg, nil, nil, diags
+		}
+	}
+
+	return cfg, plan, schemas, diags
+}
+
+// loadJournalPlan loads the plan recorded in the journal of an earlier apply
+// that didn't complete, leaving out the steps that it already completed.
+func loadJournalPlan(opts *Options, prep *prepDir, view ui) (*Config, *importPlan, *tfjson.ProviderSchemas, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	cfg, moreDiags := LoadConfig(opts.dir())
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
+	}
+
+	filename := journalFilename(opts)
+	plan, progress, err := readImportJournal(filename, opts.dir())
+	if os.IsNotExist(err) {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Nothing to resume",
+			Detail:   fmt.Sprintf("There is no unfinished apply to resume in %s.", opts.dir()),
+		})
+		return cfg, nil, nil, diags
+	} else if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read journal",
+			Detail:   fmt.Sprintf("Could not read the progress of the earlier apply from %s: %s.", filename, err),
+		})
+		return cfg, nil, nil, diags
+	}
+
+	// We can't compare the fingerprint of the configuration or the state
+	// serial as we would for a saved plan, because the earlier apply changed
+	// both, but we can at least make sure it's still the same state.
+	tf, err := tfexec.NewTerraform(opts.dir(), opts.TerraformExec)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to initialize Terraform CLI",
+			Detail:   fmt.Sprintf("Terraform executable at %s is malfunctioning or not available: %s.", opts.TerraformExec, err),
+		})
+		return cfg, nil, nil, diags
+	}
+	state, err := tf.Show(context.Background())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read current state",
+			Detail:   fmt.Sprintf("Could not read the latest state snapshot for this configuration:\n\n%s", err),
+		})
+		return cfg, nil, nil, diags
+	}
+	_, currentState, err := pullState(context.Background(), opts.TerraformExec, opts.dir())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to read current state",
+			Detail:   fmt.Sprintf("Could not read the latest state snapshot for this configuration:\n\n%s", err),
+		})
+		return cfg, nil, nil, diags
+	}
+	if plan.State.Lineage != "" && currentState.Lineage != plan.State.Lineage {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Journal is for a different state",
+			Detail:   fmt.Sprintf("The unfinished apply recorded in %s was for a different Terraform state than the current one, so it can't be resumed.\n\nDelete %s and create a new plan with \"terrafy plan\".", filename, journalFile),
+		})
+		return cfg, nil, nil, diags
+	}
+
+	// We only trust the journal to say which steps are complete, because
+	// other resources in the state or the configuration may well have been
+	// written by hand, and we mustn't treat those as generated when we
+	// infer references. The one exception is an instance of this plan that
+	// is already in the state, which the earlier apply must have imported
+	// just before it was interrupted, since importing it again would fail.
+	inState := make(map[string]bool)
+	for _, rs := range allStateResources(state) {
+		inState[rs.InstanceAddr().String()] = true
+	}
+	toState := plan.ToState[:0]
+	for _, action := range plan.ToState {
+		addr := action.Target.String()
+		if !progress.Imported[addr] && !inState[addr] {
+			toState = append(toState, action)
+		}
+	}
+	toConfig := plan.ToConfig[:0]
+	for _, action := range plan.ToConfig {
+		if !progress.Generated[action.Target] {
+			toConfig = append(toConfig, action)
+		} else {
+			plan.Generated = append(plan.Generated, action.Target)
+		}
+	}
+	view.Resuming(len(plan.ToState)-len(toState), len(plan.ToConfig)-len(toConfig))
+	plan.ToState = toState
+	plan.ToConfig = toConfig
+
+	schemas, moreDiags := fetchSchemas(prep, cfg)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return cfg, nil, nil, diags
+	}
+
+	return cfg, plan, schemas, diags
+}
+
+// fetchSchemas installs all of the required providers into the given
+// temporary working directory and then returns their schemas.
+func fetchSchemas(prep *prepDir, cfg *Config) (*tfjson.ProviderSchemas, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	moreDiags := generateProviderRequirements(prep.Dir, cfg.ProviderReqs, cfg.SourceFiles)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		// If we couldn't generate the requirements file then the rest of
+		// this will not succeed either.
+		return nil, diags
+	}
+
+	err := prep.TF.Init(context.Background())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to initialize temporary working directory",
+			Detail:   fmt.Sprintf("Could not initialize a temporary working directory to handle the import:\n\n%s", err),
+		})
+		return nil, diags
+	}
+
+	schemas, err := prep.TF.ProvidersSchema(context.Background())
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to retrieve provider schemas",
+			Detail:   fmt.Sprintf("Could not retrieve the schemas for the required providers:\n\n%s", err),
+		})
+		return nil, diags
+	}
+
+	return schemas, diags
+}
+
+func generateProviderRequirements(targetDir string, reqs map[string]hcl.Expression, files map[string]*hcl.File) hcl.Diagnostics {
+	// Terraform only installs providers that are actually used by something
+	// in the configuration, so we'll also generate a temporary file
+	// with some placeholder "provider" blocks to force the installation
+	// of each provider. We'll overwrite providers.tf with a real set of
+	// provider configurations in a later step, once we've got all the
+	// providers installed so we can see their schemas.
+	versionsFilename := filepath.Join(targetDir, "versions.tf")
+	providersFilename := filepath.Join(targetDir, "providers.tf")
+	var diags hcl.Diagnostics
+	versionsFile := hclwrite.NewEmptyFile()
+	providersFile := hclwrite.NewEmptyFile()
+
+	tfBlock := versionsFile.Body().AppendNewBlock("terraform", nil)
+	reqsBlock := tfBlock.Body().AppendNewBlock("required_providers", nil)
+	names := make([]string, 0, len(reqs))
+
+	for name := range reqs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expr := reqs[name]
+		val, moreDiags := expr.Value(nil)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			continue
+		}
+		reqsBlock.Body().SetAttributeValue(name, val)
+
+		providersFile.Body().AppendNewBlock("provider", []string{name})
+	}
+
+	err := ioutil.WriteFile(versionsFilename, versionsFile.Bytes(), 0700)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to create provider requirements file",
+			Detail:   fmt.Sprintf("Could not create a temporary provider requirements file: %s.", err),
+		})
+		return diags
+	}
+
+	err = ioutil.WriteFile(providersFilename, providersFile.Bytes(), 0700)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to create provider configurations file",
+			Detail:   fmt.Sprintf("Could not create a temporary provider configurations file: %s.", err),
+		})
+		return diags
+	}
+
+	return diags
+}
+
+func generatePrepConfig(targetDir string, cfg *Config) (*sourceMap, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	sm := newSourceMap(cfg.SourceFiles)
+
+	// We're going to copy raw chunks of configuration byte-for-byte
+	// from the input into the temporary config. Blocks written in native
+	// syntax go into .tf files, while blocks written in JSON syntax go
+	// into sidecar .tf.json files, because we can't paste JSON verbatim
+	// into a native syntax file.
+	//
+	// We build the files directly as bytes, rather than using hclwrite,
+	// so that we can keep track of exactly where each copied chunk ends
+	// up. That allows us to translate any errors Terraform reports about
+	// the temporary configuration back to the original source locations.
+	// The result is not formatted idiomatically, but the temporary
+	// configuration is not intended for human consumption anyway.
+	moreDiags := generatePrepVariables(targetDir, cfg, sm)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return sm, diags
+	}
+
+	providersNativeFilename := filepath.Join(targetDir, "providers.tf")
+	providersNativeFile := &prepFileBuilder{}
+	providersJSONFilename := filepath.Join(targetDir, "providers.tf.json")
+	providersJSONBodies := map[string][]jsonBlockBody{}
+	dataNativeFilename := filepath.Join(targetDir, "data.tf")
+	dataNativeFile := &prepFileBuilder{}
+	dataJSONFilename := filepath.Join(targetDir, "data.tf.json")
+	dataJSONBodies := map[string]map[string]jsonBlockBody{}
+
+	providerKeys := make([]string, 0, len(cfg.ProviderConfigs))
+	for key := range cfg.ProviderConfigs {
+		providerKeys = append(providerKeys, key)
+	}
+	sort.Strings(providerKeys)
+	for _, key := range providerKeys {
+		block := cfg.ProviderConfigs[key]
+		name, alias := key, ""
+		if dot := strings.Index(key, "."); dot >= 0 {
+			name, alias = key[:dot], key[dot+1:]
+		}
+		body, ok := block.Body.(*hclsyntax.Body)
+		if !ok {
+			jsonBody, ok := findJSONProviderBody(cfg.SourceFiles, block, alias)
+			if !ok {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Skipping provider configuration declared in JSON",
+					Detail:   fmt.Sprintf("Terrafy could not find the source code of the JSON provider configuration %s.\n\nIf your Terrafy configuration depends on this provider configuration then the import may fail. Reproduce the provider configuration in one of your .tfy files, if so.", key),
+					Subject:  block.DefRange.Ptr(),
+				})
+				continue
+			}
+			providersJSONBodies[name] = append(providersJSONBodies[name], jsonBody)
+			continue
+		}
+		providersNativeFile.WriteString(fmt.Sprintf("provider %q {", name))
+		providersNativeFile.WriteSource(blockBodyInnerRange(body), cfg.SourceFiles[body.SrcRange.Filename])
+		providersNativeFile.WriteString("}\n\n")
+	}
+
+	err := ioutil.WriteFile(providersNativeFilename, providersNativeFile.Bytes(), 0700)
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to create provider configurations file",
+			Detail:   fmt.Sprintf("Could not create a temporary provider configurations file: %s.", err),
+		})
+		return sm, diags
+	}
+	sm.AddFile(providersNativeFilename, providersNativeFile)
+
+	if len(providersJSONBodies) != 0 {
+		providersJSONFile := &prepFileBuilder{}
+		providersJSONFile.WriteString("{\n\"provider\": {\n")
+		names := make([]string, 0, len(providersJSONBodies))
+		for name := range providersJSONBodies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			if i > 0 {
+				providersJSONFile.WriteString(",\n")
+			}
+			providersJSONFile.WriteString(fmt.Sprintf("%s: [\n", jsonString(name)))
+			for j, jsonBody := range providersJSONBodies[name] {
+				if j > 0 {
+					providersJSONFile.WriteString(",\n")
+				}
+				providersJSONFile.WriteSourceBytes(jsonBody.Raw, jsonBody.Filename, jsonBody.Start)
+			}
+			providersJSONFile.WriteString("\n]")
+		}
+		providersJSONFile.WriteString("\n}\n}\n")
+
+		err := ioutil.WriteFile(providersJSONFilename, providersJSONFile.Bytes(), 0700)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to create provider configurations file",
+				Detail:   fmt.Sprintf("Could not create a temporary JSON provider configurations file: %s.", err),
+			})
+			return sm, diags
+		}
+		sm.AddFile(providersJSONFilename, providersJSONFile)
+	}
+
+	dataAddrs := make([]resourceAddr, 0, len(cfg.DataResources))
+	for addr := range cfg.DataResources {
+		dataAddrs = append(dataAddrs, addr)
+	}
+	sort.Slice(dataAddrs, func(i, j int) bool {
+		return dataAddrs[i].String() < dataAddrs[j].String()
+	})
+	for _, addr := range dataAddrs {
+		block := cfg.DataResources[addr]
+		body, ok := block.Body.(*hclsyntax.Body)
+		if !ok {
+			jsonBody, ok := findJSONBlockBody(cfg.SourceFiles, block, nil)
+			if !ok {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Skipping data resource configuration declared in JSON",
+					Detail:   fmt.Sprintf("Terrafy could not find the source code of the JSON configuration for %s, so it will not be available to the import blocks.", addr),
+					Subject:  block.DefRange.Ptr(),
+				})
+				continue
+			}
+			if dataJSONBodies[addr.Type] == nil {
+				dataJSONBodies[addr.Type] = map[string]jsonBlockBody{}
+			}
+			dataJSONBodies[addr.Type][addr.Name] = jsonBody
+			continue
+		}
+		dataNativeFile.WriteString(fmt.Sprintf("data %q %q {", addr.Type, addr.Name))
+		dataNativeFile.WriteSource(blockBodyInnerRange(body), cfg.SourceFiles[body.SrcRange.Filename])
+		dataNativeFile.WriteString("}\n\n")
+	}
+
+	importAddrs := make([]resourceAddr, 0, len(cfg.ImportConfigs))
+	for addr := range cfg.ImportConfigs {
+		importAddrs = append(importAddrs, addr)
+	}
+	sort.Slice(importAddrs, func(i, j int) bool {
+		return importAddrs[i].String() < importAddrs[j].String()
+	})
+	var jsonImportAddrs []resourceAddr
+	dataNativeFile.WriteString("output \"ids\" {\n  value = {\n")
+	for _, addr := range importAddrs {
+		imp := cfg.ImportConfigs[addr]
+		sourceRange := imp.ID.Range()
+		if _, native := imp.ID.(hclsyntax.Expression); !native {
+			jsonImportAddrs = append(jsonImportAddrs, addr)
+			continue
+		}
+		dataNativeFile.WriteString(fmt.Sprintf("    %q = ", addr.String()))
+		if imp.ForEach != nil {
+			// We emulate Terraform's own for_each by first converting the
+			// collection into a list of objects shaped like "each", and
+			// then evaluating the id once for each of them.
+			forEachRange := imp.ForEach.Range()
+			dataNativeFile.WriteString("{ for each in [for k, v in (")
+			dataNativeFile.WriteSource(forEachRange, cfg.SourceFiles[forEachRange.Filename])
+			dataNativeFile.WriteString(") : { key = k, value = v }] : each.key => (")
+			dataNativeFile.WriteSource(sourceRange, cfg.SourceFiles[sourceRange.Filename])
+			dataNativeFile.WriteString(") }\n")
+			continue
+		}
+		dataNativeFile.WriteSource(sourceRange, cfg.SourceFiles[sourceRange.Filename])
+		dataNativeFile.WriteString("\n")
 	}
+	dataNativeFile.WriteString("  }\n}\n")
 
-	fmt.Printf("\nDo you want to proceed? (Only \"yes\" will be accepted to confirm.)\n> ")
-	termR := bufio.NewReader(os.Stdin)
-	answer, err := termR.ReadString('\n')
+	err = ioutil.WriteFile(dataNativeFilename, dataNativeFile.Bytes(), 0700)
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to read confirmation",
-			Detail:   fmt.Sprintf("Error reading the confirmation response: %s.", err),
+			Summary:  "Failed to create data configuration file",
+			Detail:   fmt.Sprintf("Could not create a temporary data configuration file: %s.", err),
 		})
-		return cfg.SourceFiles, diags
-	}
-	answer = strings.TrimSpace(answer)
-	if answer != "yes" {
-		fmt.Printf("Cancelled.\n")
-		return cfg.SourceFiles, diags
+		return sm, diags
 	}
-	fmt.Println("")
+	sm.AddFile(dataNativeFilename, dataNativeFile)
 
-	moreDiags = applyImporting(plan, tf, schemas)
-	diags = append(diags, moreDiags...)
+	if len(dataJSONBodies) != 0 || len(jsonImportAddrs) != 0 {
+		// The ids for any imports declared in JSON syntax go into a separate
+		// output value, which makePlan merges with the main "ids" output.
+		dataJSONFile := &prepFileBuilder{}
+		dataJSONFile.WriteString("{\n")
+		if len(dataJSONBodies) != 0 {
+			dataJSONFile.WriteString("\"data\": {\n")
+			types := make([]string, 0, len(dataJSONBodies))
+			for typeName := range dataJSONBodies {
+				types = append(types, typeName)
+			}
+			sort.Strings(types)
+			for i, typeName := range types {
+				if i > 0 {
+					dataJSONFile.WriteString(",\n")
+				}
+				dataJSONFile.WriteString(fmt.Sprintf("%s: {\n", jsonString(typeName)))
+				names := make([]string, 0, len(dataJSONBodies[typeName]))
+				for name := range dataJSONBodies[typeName] {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for j, name := range names {
+					if j > 0 {
+						dataJSONFile.WriteString(",\n")
+					}
+					jsonBody := dataJSONBodies[typeName][name]
+					dataJSONFile.WriteString(fmt.Sprintf("%s: ", jsonString(name)))
+					dataJSONFile.WriteSourceBytes(jsonBody.Raw, jsonBody.Filename, jsonBody.Start)
+				}
+				dataJSONFile.WriteString("\n}")
+			}
+			dataJSONFile.WriteString("\n},\n")
+		}
+		dataJSONFile.WriteString(fmt.Sprintf("\"output\": {\n%s: {\n\"value\": {\n", jsonString(prepJSONIDsOutput)))
+		for i, addr := range jsonImportAddrs {
+			if i > 0 {
+				dataJSONFile.WriteString(",\n")
+			}
+			imp := cfg.ImportConfigs[addr]
+			sourceRange := imp.ID.Range()
+			dataJSONFile.WriteString(fmt.Sprintf("%s: ", jsonString(addr.String())))
+			dataJSONFile.WriteSource(sourceRange, cfg.SourceFiles[sourceRange.Filename])
+		}
+		dataJSONFile.WriteString("\n}\n}\n}\n}\n")
 
-	return cfg.SourceFiles, diags
+		err := ioutil.WriteFile(dataJSONFilename, dataJSONFile.Bytes(), 0700)
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to create data configuration file",
+				Detail:   fmt.Sprintf("Could not create a temporary JSON data configuration file: %s.", err),
+			})
+			return sm, diags
+		}
+		sm.AddFile(dataJSONFilename, dataJSONFile)
+	}
+
+	return sm, diags
 }
 
-func generateProviderRequirements(targetDir string, reqs map[string]hcl.Expression, files map[string]*hcl.File) hcl.Diagnostics {
-	// Terraform only installs providers that are actually used by something
-	// in the configuration, so we'll also generate a temporary file
-	// with some placeholder "provider" blocks to force the installation
-	// of each provider. We'll overwrite providers.tf with a real set of
-	// provider configurations in a later step, once we've got all the
-	// providers installed so we can see their schemas.
-	versionsFilename := filepath.Join(targetDir, "versions.tf")
-	providersFilename := filepath.Join(targetDir, "providers.tf")
+// generatePrepVariables generates the part of the temporary configuration
+// that declares the input variables and local values from the .tfy files,
+// recording the origins of the copied source code in the given source map.
+func generatePrepVariables(targetDir string, cfg *Config, sm *sourceMap) hcl.Diagnostics {
 	var diags hcl.Diagnostics
-	versionsFile := hclwrite.NewEmptyFile()
-	providersFile := hclwrite.NewEmptyFile()
 
-	tfBlock := versionsFile.Body().AppendNewBlock("terraform", nil)
-	reqsBlock := tfBlock.Body().AppendNewBlock("required_providers", nil)
-	names := make([]string, 0, len(reqs))
+	if len(cfg.Variables) == 0 && len(cfg.Locals) == 0 {
+		return diags
+	}
 
-	for name := range reqs {
-		names = append(names, name)
+	varsNativeFilename := filepath.Join(targetDir, "variables.tf")
+	varsNativeFile := &prepFileBuilder{}
+	varsJSONFilename := filepath.Join(targetDir, "variables.tf.json")
+	var jsonVarNames []string
+	jsonVarBodies := map[string]jsonBlockBody{}
+	var jsonLocalNames []string
+
+	varNames := make([]string, 0, len(cfg.Variables))
+	for name := range cfg.Variables {
+		varNames = append(varNames, name)
 	}
-	sort.Strings(names)
-	for _, name := range names {
-		expr := reqs[name]
-		val, moreDiags := expr.Value(nil)
-		diags = append(diags, moreDiags...)
-		if moreDiags.HasErrors() {
+	sort.Strings(varNames)
+	for _, name := range varNames {
+		block := cfg.Variables[name]
+		body, ok := block.Body.(*hclsyntax.Body)
+		if !ok {
+			jsonBody, ok := findJSONBlockBody(cfg.SourceFiles, block, nil)
+			if !ok {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid variable declaration",
+					Detail:   fmt.Sprintf("Terrafy could not find the source code of the JSON declaration of variable %q.", name),
+					Subject:  block.DefRange.Ptr(),
+				})
+				continue
+			}
+			jsonVarNames = append(jsonVarNames, name)
+			jsonVarBodies[name] = jsonBody
 			continue
 		}
-		reqsBlock.Body().SetAttributeValue(name, val)
+		varsNativeFile.WriteString(fmt.Sprintf("variable %q {", name))
+		varsNativeFile.WriteSource(blockBodyInnerRange(body), cfg.SourceFiles[body.SrcRange.Filename])
+		varsNativeFile.WriteString("}\n\n")
+	}
 
-		providersFile.Body().AppendNewBlock("provider", []string{name})
+	localNames := make([]string, 0, len(cfg.Locals))
+	for name := range cfg.Locals {
+		localNames = append(localNames, name)
+	}
+	sort.Strings(localNames)
+	varsNativeFile.WriteString("locals {\n")
+	for _, name := range localNames {
+		attr := cfg.Locals[name]
+		if _, native := attr.Expr.(hclsyntax.Expression); !native {
+			jsonLocalNames = append(jsonLocalNames, name)
+			continue
+		}
+		varsNativeFile.WriteString("  ")
+		varsNativeFile.WriteSource(attr.Range, cfg.SourceFiles[attr.Range.Filename])
+		varsNativeFile.WriteString("\n")
+	}
+	varsNativeFile.WriteString("}\n")
+	if diags.HasErrors() {
+		return diags
 	}
 
-	err := ioutil.WriteFile(versionsFilename, versionsFile.Bytes(), 0700)
+	err := ioutil.WriteFile(varsNativeFilename, varsNativeFile.Bytes(), 0700)
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to create provider requirements file",
-			Detail:   fmt.Sprintf("Could not create a temporary provider requirements file: %s.", err),
+			Summary:  "Failed to create variables file",
+			Detail:   fmt.Sprintf("Could not create a temporary variables file: %s.", err),
 		})
 		return diags
 	}
+	sm.AddFile(varsNativeFilename, varsNativeFile)
 
-	err = ioutil.WriteFile(providersFilename, providersFile.Bytes(), 0700)
+	if len(jsonVarNames) == 0 && len(jsonLocalNames) == 0 {
+		return diags
+	}
+	varsJSONFile := &prepFileBuilder{}
+	varsJSONFile.WriteString("{\n\"variable\": {\n")
+	for i, name := range jsonVarNames {
+		if i > 0 {
+			varsJSONFile.WriteString(",\n")
+		}
+		jsonBody := jsonVarBodies[name]
+		varsJSONFile.WriteString(fmt.Sprintf("%s: ", jsonString(name)))
+		varsJSONFile.WriteSourceBytes(jsonBody.Raw, jsonBody.Filename, jsonBody.Start)
+	}
+	varsJSONFile.WriteString("\n},\n\"locals\": {\n")
+	for i, name := range jsonLocalNames {
+		if i > 0 {
+			varsJSONFile.WriteString(",\n")
+		}
+		sourceRange := cfg.Locals[name].Expr.Range()
+		varsJSONFile.WriteString(fmt.Sprintf("%s: ", jsonString(name)))
+		varsJSONFile.WriteSource(sourceRange, cfg.SourceFiles[sourceRange.Filename])
+	}
+	varsJSONFile.WriteString("\n}\n}\n")
+
+	err = ioutil.WriteFile(varsJSONFilename, varsJSONFile.Bytes(), 0700)
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to create provider configurations file",
-			Detail:   fmt.Sprintf("Could not create a temporary provider configurations file: %s.", err),
+			Summary:  "Failed to create variables file",
+			Detail:   fmt.Sprintf("Could not create a temporary JSON variables file: %s.", err),
 		})
 		return diags
 	}
+	sm.AddFile(varsJSONFilename, varsJSONFile)
 
 	return diags
 }
 
-func generatePrepConfig(targetDir string, cfg *Config) hcl.Diagnostics {
-	var diags hcl.Diagnostics
+// blockBodyInnerRange returns the range of the content of the given block
+// body, excluding its opening and closing braces.
+func blockBodyInnerRange(body *hclsyntax.Body) hcl.Range {
+	rng := body.SrcRange
+	rng.Start.Byte++
+	rng.Start.Column++
+	rng.End.Byte--
+	rng.End.Column--
+	return rng
+}
 
-	// We're going to copy raw chunks of configuration byte-for-byte
-	// from the input into the temporary config, but that means we
-	// can't support JSON because we can't just paste that verbatim
-	// into a .tf file. (Maybe later we'll generate a sidecar .tf.json
-	// file, but the HCL JSON syntax makes it harder to reliably
-	// extract a suitable raw chunk of configuration due to the
-	// different variants it supports for nested block representation.)
-	providersNativeFilename := filepath.Join(targetDir, "providers.tf")
-	providersNativeFile := hclwrite.NewEmptyFile()
-	dataNativeFilename := filepath.Join(targetDir, "data.tf")
-	dataNativeFile := hclwrite.NewEmptyFile()
+// applyPrepConfig runs "terraform apply" in the given temporary working
+// directory, in order to read all of the data resources and evaluate the
+// import ids.
+//
+// If the Terraform CLI is new enough to support machine-readable output
+// from apply, any diagnostics it returns are translated back to the original
+// source locations using the given source map.
+func applyPrepConfig(opts *Options, prep *prepDir, sm *sourceMap) hcl.Diagnostics {
+	var diags hcl.Diagnostics
 
-	for key, block := range cfg.ProviderConfigs {
-		name := key
-		if dot := strings.Index(key, "."); dot >= 0 {
-			name = key[:dot]
-		}
-		body, ok := block.Body.(*hclsyntax.Body)
-		if !ok {
+	// "terraform apply -json" was introduced in Terraform v0.15.3.
+	jsonSupported, _, err := terraformVersionAtLeast(prep.TF, 0, 15, 3)
+	if err != nil || !jsonSupported {
+		// We'll just fall back on the plain output, then.
+		err = prep.TF.Apply(context.Background(), prep.ApplyOptions()...)
+		if err != nil {
 			diags = diags.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagWarning,
-				Summary:  "Skipping provider configuration declared in JSON",
-				Detail:   fmt.Sprintf("Terrafy cannot currently incorporate provider configurations from .tf.json files.\n\nIf your Terrafy configuration depends on provider %s then the import may fail. Reproduce the provider configuration in one of your .tfy files in native syntax, if so.", key),
-				Subject:  block.DefRange.Ptr(),
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read data resources",
+				Detail:   fmt.Sprintf("Could not read the defined data resources to prepare for import:\n\n%s", err),
 			})
-			continue
-		}
-		sourceFileBytes := cfg.SourceFiles[body.SrcRange.Filename].Bytes
-		sourceBytes := body.SrcRange.SliceBytes(sourceFileBytes)
-		sourceBytes = sourceBytes[1 : len(sourceBytes)-1] // strip the braces
-		tmpFile, moreDiags := hclwrite.ParseConfig(sourceBytes, "", hcl.InitialPos)
-		diags = append(diags, moreDiags...)
-		if moreDiags.HasErrors() {
-			// It'd be weird to get here after having previously parsed the
-			// whole file successfully, but we'll be robust anyway.
-			continue
 		}
-		newBlock := providersNativeFile.Body().AppendNewBlock("provider", []string{name})
-		newBlock.Body().AppendUnstructuredTokens(tmpFile.Body().BuildTokens(nil))
+		return diags
 	}
 
-	err := ioutil.WriteFile(providersNativeFilename, providersNativeFile.Bytes(), 0700)
-	if err != nil {
+	args := append([]string{"apply", "-json", "-auto-approve", "-input=false"}, prep.VarArgs()...)
+	stdout, err := runTerraform(context.Background(), opts.TerraformExec, prep.Dir, nil, args...)
+	diags = append(diags, translatePrepDiagnostics(stdout, sm)...)
+	if err != nil && !diags.HasErrors() {
+		// If Terraform failed without reporting any errors in its JSON output
+		// then we'll report the raw error instead.
 		diags = diags.Append(&hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to create provider configurations file",
-			Detail:   fmt.Sprintf("Could not create a temporary provider configurations file: %s.", err),
+			Summary:  "Failed to read data resources",
+			Detail:   fmt.Sprintf("Could not read the defined data resources to prepare for import:\n\n%s", err),
 		})
-		return diags
+	}
+	return diags
+}
+
+// translatePrepDiagnostics finds any diagnostics in the given machine-readable
+// output from Terraform and converts them to HCL diagnostics, using the given
+// source map to translate any source ranges in the temporary configuration
+// back to the original source files.
+func translatePrepDiagnostics(stdout []byte, sm *sourceMap) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	type jsonPos struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+		Byte   int `json:"byte"`
+	}
+	type jsonRange struct {
+		Filename string  `json:"filename"`
+		Start    jsonPos `json:"start"`
+		End      jsonPos `json:"end"`
+	}
+	type jsonMessage struct {
+		Type       string `json:"type"`
+		Diagnostic *struct {
+			Severity string     `json:"severity"`
+			Summary  string     `json:"summary"`
+			Detail   string     `json:"detail"`
+			Range    *jsonRange `json:"range"`
+		} `json:"diagnostic"`
 	}
 
-	for addr, block := range cfg.DataResources {
-		body, ok := block.Body.(*hclsyntax.Body)
-		if !ok {
-			diags = diags.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagWarning,
-				Summary:  "Skipping data resource configuration not in native syntax",
-				Detail:   "Terrafy can currently only incorporate data resource configurations from Terraform files.",
-				Subject:  block.DefRange.Ptr(),
-			})
+	sc := bufio.NewScanner(bytes.NewReader(stdout))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var msg jsonMessage
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil {
+			// Not a message we can understand, so we'll ignore it.
 			continue
 		}
-		sourceFileBytes := cfg.SourceFiles[body.SrcRange.Filename].Bytes
-		sourceBytes := body.SrcRange.SliceBytes(sourceFileBytes)
-		sourceBytes = sourceBytes[1 : len(sourceBytes)-1] // strip the braces
-		tmpFile, moreDiags := hclwrite.ParseConfig(sourceBytes, "", hcl.InitialPos)
-		diags = append(diags, moreDiags...)
-		if moreDiags.HasErrors() {
-			// It'd be weird to get here after having previously parsed the
-			// whole file successfully, but we'll be robust anyway.
+		if msg.Type != "diagnostic" || msg.Diagnostic == nil {
 			continue
 		}
-		newBlock := dataNativeFile.Body().AppendNewBlock("data", []string{addr.Type, addr.Name})
-		newBlock.Body().AppendUnstructuredTokens(tmpFile.Body().BuildTokens(nil))
-	}
-
-	var hackyOutputTokens hclwrite.Tokens
-	hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-		Type:  hclsyntax.TokenOBrace,
-		Bytes: []byte{'{'},
-	})
-	hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-		Type:  hclsyntax.TokenNewline,
-		Bytes: []byte{'\n'},
-	})
-	for addr, imp := range cfg.ImportConfigs {
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenOQuote,
-			Bytes: []byte{'"'},
-		})
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenQuotedLit,
-			Bytes: []byte(addr.String()),
-		})
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenCQuote,
-			Bytes: []byte{'"'},
-		})
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenEqual,
-			Bytes: []byte{'='},
-		})
-		sourceRange := imp.ID.Range()
-		sourceFileBytes := cfg.SourceFiles[sourceRange.Filename].Bytes
-		sourceBytes := sourceRange.SliceBytes(sourceFileBytes)
-		// EVIL: here we're exploiting the fact that we don't actually
-		// intend to re-access the tokens here, and this input is not
-		// intended for human consumption anyway so we don't need to worry
-		// too much about canonical formatting, and so we can lie to hclwrite
-		// and pretend these whole buffers are single tokens... they'll just
-		// get concatenated as-is into the output anyway. Perhaps one day
-		// hclwrite will have a function for parsing an isolated expression,
-		// but it doesn't today.
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenInvalid,
-			Bytes: sourceBytes,
-		})
-		hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-			Type:  hclsyntax.TokenNewline,
-			Bytes: []byte{'\n'},
-		})
-	}
-	hackyOutputTokens = append(hackyOutputTokens, &hclwrite.Token{
-		Type:  hclsyntax.TokenCBrace,
-		Bytes: []byte{'}'},
-	})
-	newBlock := dataNativeFile.Body().AppendNewBlock("output", []string{"ids"})
-	newBlock.Body().SetAttributeRaw("value", hackyOutputTokens)
 
-	err = ioutil.WriteFile(dataNativeFilename, dataNativeFile.Bytes(), 0700)
-	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{
+		diag := &hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Failed to create data configuration file",
-			Detail:   fmt.Sprintf("Could not create a temporary data configuration file: %s.", err),
-		})
-		return diags
+			Summary:  msg.Diagnostic.Summary,
+			Detail:   msg.Diagnostic.Detail,
+		}
+		if msg.Diagnostic.Severity == "warning" {
+			diag.Severity = hcl.DiagWarning
+		}
+		if r := msg.Diagnostic.Range; r != nil {
+			genRange := hcl.Range{
+				Filename: r.Filename,
+				Start:    hcl.Pos{Line: r.Start.Line, Column: r.Start.Column, Byte: r.Start.Byte},
+				End:      hcl.Pos{Line: r.End.Line, Column: r.End.Column, Byte: r.End.Byte},
+			}
+			if srcRange, ok := sm.Translate(genRange); ok {
+				diag.Subject = srcRange.Ptr()
+			} else {
+				// If the problem is in a part of the temporary configuration
+				// that Terrafy generated itself then there's nowhere
+				// useful for us to point, but we'll at least mention
+				// that it came from the temporary configuration.
+				diag.Detail = fmt.Sprintf("%s\n\n(This problem was reported in Terrafy's temporary configuration, at %s.)", diag.Detail, genRange)
+			}
+		}
+		diags = append(diags, diag)
 	}
 
 	return diags
 }
 
-func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraform) (*importPlan, hcl.Diagnostics) {
+func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraform, dir string) (*importPlan, hcl.Diagnostics) {
 	var diags hcl.Diagnostics
 
 	state, err := tf.Show(context.Background())
@@ -398,13 +1197,11 @@ func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraf
 		})
 		return nil, diags
 	}
-	var existing []*tfjson.StateResource
-	if state.Values != nil && state.Values.RootModule != nil {
-		existing = state.Values.RootModule.Resources
-	}
+	existing := allStateResources(state)
 
 	var importToState []*importPlanState
 	var importToConfig []*importPlanConfig
+	plannedConfig := map[resourceAddr]bool{}
 	for addrStr, rawIds := range idsRaw {
 		var imp *ImportConfig
 		var addr resourceAddr
@@ -440,6 +1237,10 @@ func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraf
 					continue Instances
 				}
 			}
+			// Likewise if there's already a pending import block for it.
+			if _, pending := cfg.ImportBlocks[instAddr.String()]; pending {
+				continue Instances
+			}
 
 			importToState = append(importToState, &importPlanState{
 				ID:     id,
@@ -447,12 +1248,35 @@ func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraf
 			})
 		}
 
-		_, alreadyInConfig := cfg.ManagedResources[addr]
-		if !alreadyInConfig {
-			sourceFilename := imp.DefRange.Filename
-			targetFilename := "imported.tf"
-			if strings.HasSuffix(sourceFilename, ".tfy") {
-				targetFilename = sourceFilename[:len(sourceFilename)-1]
+		// All instances of a module share the same configuration, so we
+		// need to generate configuration for the resource in the module
+		// itself, at most once.
+		configAddr := addr.ConfigAddr()
+		_, alreadyInConfig := cfg.ManagedResources[configAddr]
+		if !alreadyInConfig && !plannedConfig[configAddr] {
+			plannedConfig[configAddr] = true
+			targetDir := dir
+			if configAddr.Module != "" {
+				targetDir = cfg.ModuleDirs[configAddr.Module]
+			}
+			sourceFilename := filepath.Base(imp.DefRange.Filename)
+			targetFilename := filepath.Join(targetDir, "imported.tf")
+			switch {
+			case strings.HasSuffix(sourceFilename, ".tfy"):
+				targetFilename = filepath.Join(targetDir, sourceFilename[:len(sourceFilename)-1])
+			case strings.HasSuffix(sourceFilename, ".tfy.json"):
+				// Resources imported from a JSON file are generated into a
+				// native syntax file of the same base name by default.
+				// Choosing a .tf.json file below selects the JSON syntax
+				// instead.
+				targetFilename = filepath.Join(targetDir, strings.TrimSuffix(sourceFilename, ".tfy.json")+".tf")
+			}
+			// An explicit choice of file takes priority over all of that.
+			switch {
+			case imp.File != "":
+				targetFilename = filepath.Join(targetDir, imp.File)
+			case cfg.Settings.DefaultFile != "":
+				targetFilename = filepath.Join(targetDir, cfg.Settings.DefaultFile)
 			}
 
 			var repeatMode string
@@ -466,9 +1290,15 @@ func planImporting(cfg *Config, idsRaw map[string]interface{}, tf *tfexec.Terraf
 			}
 
 			importToConfig = append(importToConfig, &importPlanConfig{
-				Target:     addr,
+				Target:     configAddr,
 				RepeatMode: repeatMode,
 				Filename:   targetFilename,
+				Provider:   imp.Provider,
+				Template:   imp.Template,
+
+				IgnoreAttributes: imp.IgnoreAttributes,
+				OnlyAttributes:   imp.OnlyAttributes,
+				Overrides:        imp.Overrides,
 			})
 		}
 	}
@@ -516,17 +1346,39 @@ func prepareRawIDs(raw interface{}) (cty.Value, error) {
 	}
 }
 
-func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.ProviderSchemas) hcl.Diagnostics {
+func applyImporting(opts *Options, cfg *Config, plan *importPlan, tf *tfexec.Terraform, prep *prepDir, schemas *tfjson.ProviderSchemas, tx *importTransaction, jnl *importJournal, view ui) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 
-	fmt.Printf("Importing:\n")
+	// When generating import blocks we still need to import the objects
+	// somewhere in order to generate their configuration, so we import them
+	// into the throwaway local state of our temporary working directory
+	// and leave the real state untouched.
+	importTF := tf
+	importOpts := []tfexec.ImportOption{tfexec.AllowMissingConfig(true)}
+	if plan.ImportBlocksFile != "" {
+		importTF = prep.TF
+		// The temporary configuration may also include input variables
+		// from the .tfy files, which need values in order to import.
+		importOpts = prep.ImportOptions(importOpts...)
+	}
+
+	stubsDir := ""
+	if plan.ImportBlocksFile != "" {
+		stubsDir = prep.Dir
+	}
+	removeStubs, moreDiags := writeProviderStubs(plan, stubsDir)
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		diags = append(diags, removeStubs()...)
+		return diags
+	}
+
+	view.ImportStart(plan)
 	for _, action := range plan.ToState {
 		targetStr := action.Target.String()
-		dispTargetStr := strings.Replace(targetStr, "'", "'\\''", 0)
-		dispIDStr := strings.Replace(action.ID, "'", "'\\''", 0)
-		fmt.Printf("- terraform import '%s' '%s'\n", dispTargetStr, dispIDStr)
+		view.Importing(action)
 
-		err := tf.Import(context.Background(), targetStr, action.ID, tfexec.AllowMissingConfig(true))
+		err := importTF.Import(context.Background(), targetStr, action.ID, importOpts...)
 		if err != nil {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
@@ -539,14 +1391,30 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 			// see a series of repeated similar failures, if the problem is
 			// a general one, such as the state storage server being
 			//  unreachable.
+			diags = append(diags, removeStubs()...)
+			return diags
+		}
+		tx.recordImport(action.Target)
+		moreDiags := jnl.recordImport(action)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			diags = append(diags, removeStubs()...)
 			return diags
 		}
 	}
 
+	// The stubs must be gone before we generate the real resource blocks,
+	// which would otherwise conflict with them.
+	moreDiags = removeStubs()
+	diags = append(diags, moreDiags...)
+	if moreDiags.HasErrors() {
+		return diags
+	}
+
 	// The import operations above should've updated the state, so we'll
 	// now need to fetch a fresh snapshot to get the data for those
 	// imported objects so we can copy the values into the configuration.
-	fmt.Printf("- fetching the latest Terraform state snapshot\n")
+	view.FetchingState()
 	state, err := tf.Show(context.Background())
 	if err != nil {
 		diags = diags.Append(&hcl.Diagnostic{
@@ -556,13 +1424,49 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 		})
 		return diags
 	}
-	var existing []*tfjson.StateResource
-	if state.Values != nil && state.Values.RootModule != nil {
-		existing = state.Values.RootModule.Resources
+	existing := allStateResources(state)
+
+	if plan.ImportBlocksFile != "" && len(plan.ToState) != 0 {
+		view.WritingImportBlocks(plan.ImportBlocksFile, len(plan.ToState))
+		moreDiags := writeImportBlocks(plan.ImportBlocksFile, plan.ToState)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return diags
+		}
+
+		// The objects we just imported are only in the temporary state,
+		// so we'll need to look there too.
+		stagedState, err := prep.TF.Show(context.Background())
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read state snapshot",
+				Detail:   fmt.Sprintf("Could not read the temporary Terraform state snapshot:\n\n%s", err),
+			})
+			return diags
+		}
+		existing = append(existing, allStateResources(stagedState)...)
+	}
+
+	generating := make(map[resourceAddr]bool, len(plan.ToConfig)+len(plan.Generated))
+	for _, action := range plan.ToConfig {
+		generating[action.Target] = true
+	}
+	for _, addr := range plan.Generated {
+		generating[addr] = true
+	}
+	refs := newReferenceIndex(existing, generating)
+	for _, addr := range plan.Generated {
+		// The configuration we generated before might already refer to
+		// some of the resources we're about to generate, so we must not
+		// refer back to it from them.
+		if block := cfg.ManagedResources[addr]; block != nil {
+			refs.addConfigDeps(addr, block, generating)
+		}
 	}
 
 	for _, action := range plan.ToConfig {
-		fmt.Printf("- adding a new resource %q %q block to %s\n", action.Target.Type, action.Target.Name, action.Filename)
+		view.GeneratingConfig(action)
 
 		// We need to collect up all of the (potentially many) instances that
 		// are associated with this resource, which we'll use to derive our
@@ -574,33 +1478,23 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 		// not be idomatic Terraform code like a human would've written.
 		instances := map[resourceInstanceAddr]*tfjson.StateResource{}
 		var schema *tfjson.Schema
+		var providerAddr string
 		for _, rs := range existing {
 			thisAddr := resourceAddr{
-				Mode: rs.Mode,
-				Type: rs.Type,
-				Name: rs.Name,
+				Module: rs.Module,
+				Mode:   rs.Mode,
+				Type:   rs.Type,
+				Name:   rs.Name,
 			}
-			if thisAddr != action.Target {
+			if thisAddr.ConfigAddr() != action.Target {
 				continue
 			}
-			index := rs.Index
-			if f, ok := index.(float64); ok {
-				// The tfjson docs state that Index will be an int for
-				// instances created with "count", but in practice it seems
-				// to use float64, at least in some cases. Therefore we'll
-				// tolerate that here, but in a way that is resilient to
-				// the bug being fixed upstream later.
-				index = int(f)
-			}
-			instAddr := resourceInstanceAddr{
-				Resource:    thisAddr,
-				InstanceKey: index,
-			}
-			instances[instAddr] = rs
+			instAddr := rs.InstanceAddr()
+			instances[instAddr] = rs.StateResource
 
 			// We'll need to check if the saved data is in the current
 			// schema version, because we can't interpret if not.
-			providerAddr := rs.ProviderName
+			providerAddr = rs.ProviderName
 			providerSchema := schemas.Schemas[providerAddr]
 			if providerSchema == nil {
 				diags = diags.Append(&hcl.Diagnostic{
@@ -637,23 +1531,61 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 			oldSrc = src
 		}
 
-		f, moreDiags := hclwrite.ParseConfig(oldSrc, action.Filename, hcl.InitialPos)
-		diags = append(diags, moreDiags...)
-		if moreDiags.HasErrors() {
-			// Something funny seems to be going on, because we presumably
-			// managed to parse this same file earlier on using the main
-			// hclsyntax parser.
-			return diags
+		var f *hclwrite.File
+		jsonTarget := isJSONConfigFile(action.Filename)
+		if jsonTarget {
+			// We generate into a native syntax stand-in for the JSON file
+			// in the same way as for a native file, and then convert only
+			// the new blocks to JSON afterwards.
+			f = shadowJSONConfig(oldSrc)
+		} else {
+			var moreDiags hcl.Diagnostics
+			f, moreDiags = hclwrite.ParseConfig(oldSrc, action.Filename, hcl.InitialPos)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				// Something funny seems to be going on, because we presumably
+				// managed to parse this same file earlier on using the main
+				// hclsyntax parser.
+				return diags
+			}
 		}
 
 		body := f.Body()
-		body.AppendNewline()
-		block := body.AppendNewBlock("resource", []string{action.Target.Type, action.Target.Name})
+		oldBlockCount := len(body.Blocks())
+		genOpts := newGenOptions(&cfg.Settings, action.Target, providerAddr)
+		genOpts.References = refs
+		genOpts.addImportRules(action.IgnoreAttributes, action.OnlyAttributes, action.Overrides)
+		for name := range templateNames(action.Template) {
+			// The generate block takes priority over the imported values.
+			genOpts.SkipArguments[name] = true
+		}
+		for _, name := range declaredVariables(filepath.Dir(action.Filename)) {
+			genOpts.ReservedVariables[name] = true
+		}
+
+		// We'll add the block to the file only once we've generated it,
+		// because we might need to declare some variables before it.
+		block := hclwrite.NewBlock("resource", []string{action.Target.Type, action.Target.Name})
 		blockBody := block.Body()
 		hasMetaArgs := false // set to true if we add any meta-arguments below
+		var localName string // set if we need to declare a local value for for_each
 		switch action.RepeatMode {
 		case "for_each":
 			hasMetaArgs = true
+			if cfg.Settings.ForEachStyle == forEachStyleLocals {
+				// We'll declare the local value once we know what values
+				// the instances need.
+				localName = localValueName(action.Target, filepath.Dir(action.Filename))
+				genOpts.LocalValues = map[string]map[string]cty.Value{}
+				for addr := range instances {
+					if k, ok := addr.InstanceKey.(string); ok {
+						genOpts.LocalValues[k] = map[string]cty.Value{}
+					}
+				}
+				blockBody.SetAttributeTraversal("for_each", localValueTraversal(localName))
+				break
+			}
+
 			// With the information we have we can only determine the for_each
 			// keys, not any values they ought to be associated with. Therefore
 			// we'll generate a for_each over a set to start, but annotate
@@ -727,9 +1659,10 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 			count := highest + 1
 			blockBody.SetAttributeValue("count", cty.NumberIntVal(int64(count)))
 		}
-		// TODO: If the state shows this resource as belonging to a provider
-		// configuration other than the one its type name seems to imply,
-		// we'll need to generate a "provider = " declaration.
+		if action.Provider != "" {
+			hasMetaArgs = true
+			blockBody.SetAttributeTraversal("provider", providerConfigTraversal(action.Provider))
+		}
 
 		if hasMetaArgs {
 			// Separate the meta-arguments from the main arguments.
@@ -740,7 +1673,7 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 			// If we have at least one instance then we should've populated
 			// "schema" above based on one of the instances, so we can
 			// safely use it here.
-			moreDiags := generateResourceConfig(action.Target, instances, schema, blockBody)
+			moreDiags := generateResourceConfig(action.Target, instances, schema, genOpts, blockBody)
 			diags = append(diags, moreDiags...)
 			if moreDiags.HasErrors() {
 				return diags
@@ -762,20 +1695,94 @@ func applyImporting(plan *importPlan, tf *tfexec.Terraform, schemas *tfjson.Prov
 			})
 		}
 
-		newSrc := f.Bytes()
-		err := ioutil.WriteFile(action.Filename, newSrc, os.ModePerm)
-		if err != nil {
-			diags = diags.Append(&hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Failed to update configuration file",
-				Detail:   fmt.Sprintf("Could not update %s with new configuration for %s: %s.", action.Filename, action.Target, err),
-			})
+		// Anything from the generate block goes at the end, after the
+		// arguments we generated.
+		moreDiags = appendTemplate(blockBody, action.Template)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
+			return diags
+		}
+
+		for _, v := range genOpts.Variables {
+			body.AppendNewline()
+			appendVariableBlock(body, v)
+		}
+		if localName != "" {
+			body.AppendNewline()
+			appendLocalsBlock(body, localName, genOpts.LocalValues)
+		}
+		body.AppendNewline()
+		body.AppendBlock(block)
+
+		tx.recordFile(action.Filename)
+		if jsonTarget {
+			moreDiags := writeJSONConfig(action.Filename, body.Blocks()[oldBlockCount:])
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				return diags
+			}
+		} else {
+			newSrc := f.Bytes()
+			err := ioutil.WriteFile(action.Filename, newSrc, 0644)
+			if err != nil {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Failed to update configuration file",
+					Detail:   fmt.Sprintf("Could not update %s with new configuration for %s: %s.", action.Filename, action.Target, err),
+				})
+				return diags
+			}
+		}
+
+		if len(genOpts.Variables) != 0 && cfg.Settings.WriteSensitiveValues {
+			if action.Target.Module != "" {
+				// The values for a child module's variables come from its
+				// module block, so a variables file can't set them.
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagWarning,
+					Summary:  "Cannot write sensitive values for a child module",
+					Detail:   fmt.Sprintf("Terrafy declared input variables for the sensitive arguments of %s, but because it belongs to a child module their values must be passed as arguments in the module block, and so Terrafy hasn't written them to %s.", action.Target, sensitiveValuesFile),
+				})
+			} else {
+				tx.recordFile(filepath.Join(opts.dir(), sensitiveValuesFile))
+				moreDiags := writeSensitiveValues(opts.dir(), genOpts.Variables)
+				diags = append(diags, moreDiags...)
+				if moreDiags.HasErrors() {
+					return diags
+				}
+			}
+		}
+
+		if opts.Minimize && len(instances) > 0 {
+			view.Minimizing(action)
+			removed, moreDiags := minimizeResourceConfig(opts, action, schema)
+			diags = append(diags, moreDiags...)
+			if moreDiags.HasErrors() {
+				return diags
+			}
+			view.Minimized(action, removed)
+		}
+
+		moreDiags := jnl.recordGenerated(action)
+		diags = append(diags, moreDiags...)
+		if moreDiags.HasErrors() {
 			return diags
 		}
 	}
 
+	// Validation problems are for the user to fix in the generated
+	// configuration, so we won't roll back or resume if it fails.
+	tx.commit()
+	diags = append(diags, jnl.remove()...)
+
+	if len(plan.ToConfig) != 0 {
+		view.ValidatingConfig()
+		moreDiags := validateGeneratedConfig(opts)
+		diags = append(diags, moreDiags...)
+	}
+
 	if !diags.HasErrors() {
-		fmt.Printf("\nAll done! Confirm the result by trying to create a Terraform plan:\n    terraform plan\n\n")
+		view.Done(plan)
 	}
 
 	return diags
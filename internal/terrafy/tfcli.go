@@ -0,0 +1,89 @@
+package terrafy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// runTerraform runs the Terraform CLI directly, for the few operations that
+// the version of tfexec we use doesn't support.
+//
+// It returns whatever Terraform wrote to its stdout. If Terraform exits
+// unsuccessfully then the returned error includes whatever it wrote to its
+// stderr.
+func runTerraform(ctx context.Context, execPath, dir string, stdin []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, execPath, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1", "TF_INPUT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.Bytes(), fmt.Errorf("%s\n\n%s", err, msg)
+		}
+		return stdout.Bytes(), err
+	}
+	return stdout.Bytes(), nil
+}
+
+// terraformVersionAtLeast returns true if the version of the given Terraform
+// CLI is at least the given version, along with the actual version string
+// for use in error messages.
+func terraformVersionAtLeast(tf *tfexec.Terraform, major, minor, patch int) (bool, string, error) {
+	tfVersion, _, err := tf.Version(context.Background(), false)
+	if err != nil {
+		return false, "", err
+	}
+	want := []int{major, minor, patch}
+	got := tfVersion.Segments()
+	for i := range want {
+		if i >= len(got) {
+			return false, tfVersion.String(), nil
+		}
+		if got[i] != want[i] {
+			return got[i] > want[i], tfVersion.String(), nil
+		}
+	}
+	return true, tfVersion.String(), nil
+}
+
+// stateMeta is the subset of a raw Terraform state snapshot that Terrafy
+// uses to recognize when the state has changed.
+type stateMeta struct {
+	Lineage string `json:"lineage"`
+	Serial  uint64 `json:"serial"`
+}
+
+// pullState retrieves the raw latest state snapshot for the configuration
+// in the given directory, along with its metadata.
+//
+// If there is not yet any state snapshot, the result is a nil snapshot and a
+// zero-value stateMeta.
+func pullState(ctx context.Context, execPath, dir string) ([]byte, stateMeta, error) {
+	var meta stateMeta
+	raw, err := runTerraform(ctx, execPath, dir, nil, "state", "pull")
+	if err != nil {
+		return nil, meta, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, meta, nil
+	}
+	err = json.Unmarshal(raw, &meta)
+	if err != nil {
+		return nil, meta, fmt.Errorf("invalid state snapshot: %s", err)
+	}
+	return raw, meta, nil
+}
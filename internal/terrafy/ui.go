@@ -0,0 +1,379 @@
+package terrafy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// ui is the interface through which Terrafy reports its progress, so that
+// the same work can be described either as prose for a human reader or as
+// a stream of JSON objects for other software to consume.
+type ui interface {
+	Valid()
+	NothingToDo()
+	Plan(plan *importPlan)
+	PlanSaved(filename string)
+	Cancelled()
+	ImportStart(plan *importPlan)
+	Importing(action *importPlanState)
+	FetchingState()
+	WritingImportBlocks(filename string, count int)
+	GeneratingConfig(action *importPlanConfig)
+	Minimizing(action *importPlanConfig)
+	Minimized(action *importPlanConfig, removed []string)
+	ValidatingConfig()
+	RollingBack(mode string)
+	Resuming(imported, generated int)
+	RolledBack(instances []resourceInstanceAddr, files []string)
+	Done(plan *importPlan)
+}
+
+func newUI(opts *Options) ui {
+	if opts.JSON {
+		return &jsonUI{w: os.Stdout}
+	}
+	return humanUI{}
+}
+
+// humanUI is the default ui implementation, which writes prose to stdout.
+type humanUI struct{}
+
+var _ ui = humanUI{}
+
+func (humanUI) Valid() {
+	fmt.Printf("The Terrafy configuration is valid.\n")
+}
+
+func (humanUI) NothingToDo() {
+	fmt.Printf("Nothing to do! Everything in your terrafy configuration is already known to Terraform.\n\n")
+}
+
+func (humanUI) Plan(plan *importPlan) {
+	fmt.Printf("Import plan:\n")
+	for _, planItem := range plan.ToState {
+		if plan.ImportBlocksFile != "" {
+			fmt.Printf("- Generate an import block in %s binding %s to remote object %q\n", plan.ImportBlocksFile, planItem.Target, planItem.ID)
+			continue
+		}
+		fmt.Printf("- Create Terraform state binding from %s to remote object %q\n", planItem.Target, planItem.ID)
+	}
+	for _, planItem := range plan.ToConfig {
+		if planItem.Provider != "" {
+			fmt.Printf("- Generate a new %s configuration block in %s, using provider configuration %s\n", planItem.Target, planItem.Filename, planItem.Provider)
+			continue
+		}
+		fmt.Printf("- Generate a new %s configuration block in %s\n", planItem.Target, planItem.Filename)
+	}
+}
+
+func (humanUI) PlanSaved(filename string) {
+	fmt.Printf("\nSaved the import plan to %s. To carry it out, run:\n    terrafy apply %s\n\n", filename, filename)
+}
+
+func (humanUI) Cancelled() {
+	fmt.Printf("Cancelled.\n")
+}
+
+func (humanUI) ImportStart(plan *importPlan) {
+	if plan.ImportBlocksFile != "" {
+		fmt.Printf("\nImporting into a temporary state to generate configuration:\n")
+		return
+	}
+	fmt.Printf("\nImporting:\n")
+}
+
+func (humanUI) Importing(action *importPlanState) {
+	dispTargetStr := strings.Replace(action.Target.String(), "'", "'\\''", -1)
+	dispIDStr := strings.Replace(action.ID, "'", "'\\''", -1)
+	fmt.Printf("- terraform import '%s' '%s'\n", dispTargetStr, dispIDStr)
+}
+
+func (humanUI) FetchingState() {
+	fmt.Printf("- fetching the latest Terraform state snapshot\n")
+}
+
+func (humanUI) WritingImportBlocks(filename string, count int) {
+	fmt.Printf("- adding %d import blocks to %s\n", count, filename)
+}
+
+func (humanUI) GeneratingConfig(action *importPlanConfig) {
+	fmt.Printf("- adding a new resource %q %q block to %s\n", action.Target.Type, action.Target.Name, action.Filename)
+}
+
+func (humanUI) Minimizing(action *importPlanConfig) {
+	fmt.Printf("- minimizing the configuration for %s\n", action.Target)
+}
+
+func (humanUI) Minimized(action *importPlanConfig, removed []string) {
+	if len(removed) == 0 {
+		fmt.Printf("- all of the arguments for %s are needed\n", action.Target)
+		return
+	}
+	fmt.Printf("- removed %s from %s\n", strings.Join(removed, ", "), action.Target)
+}
+
+func (humanUI) ValidatingConfig() {
+	fmt.Printf("- validating the generated configuration\n")
+}
+
+func (humanUI) Resuming(imported, generated int) {
+	fmt.Printf("Resuming an unfinished apply, which already imported %d instances and generated configuration for %d resources.\n\n", imported, generated)
+}
+
+func (humanUI) RollingBack(mode string) {
+	fmt.Printf("\nSomething went wrong, so Terrafy is undoing the changes it made.\n\n")
+}
+
+func (humanUI) RolledBack(instances []resourceInstanceAddr, files []string) {
+	for _, addr := range instances {
+		fmt.Printf("- removed %s from the state\n", addr)
+	}
+	for _, filename := range files {
+		fmt.Printf("- reverted the changes to %s\n", filename)
+	}
+}
+
+func (humanUI) Done(plan *importPlan) {
+	if plan.ImportBlocksFile != "" {
+		fmt.Printf("\nAll done! Review the proposed imports and then complete them by applying a Terraform plan:\n    terraform plan\n    terraform apply\n\n")
+		return
+	}
+	fmt.Printf("\nAll done! Confirm the result by trying to create a Terraform plan:\n    terraform plan\n\n")
+}
+
+// jsonUI is a ui implementation that writes one JSON object per line to
+// its writer, each describing a single event.
+//
+// Every event has a "type" property that determines which other properties
+// are present, and a "@message" property containing a human-readable
+// description of the event.
+type jsonUI struct {
+	w io.Writer
+}
+
+var _ ui = (*jsonUI)(nil)
+
+func (u *jsonUI) Valid() {
+	u.emit("valid", "The Terrafy configuration is valid.", nil)
+}
+
+func (u *jsonUI) NothingToDo() {
+	u.emit("nothing_to_do", "Everything in the Terrafy configuration is already known to Terraform.", nil)
+}
+
+func (u *jsonUI) Plan(plan *importPlan) {
+	for _, planItem := range plan.ToState {
+		fields := map[string]interface{}{
+			"target": jsonInstanceAddr(planItem.Target),
+			"id":     planItem.ID,
+		}
+		if plan.ImportBlocksFile != "" {
+			fields["import_blocks_file"] = plan.ImportBlocksFile
+		}
+		u.emit("planned_import", fmt.Sprintf("Create Terraform state binding from %s to remote object %q", planItem.Target, planItem.ID), fields)
+	}
+	for _, planItem := range plan.ToConfig {
+		fields := map[string]interface{}{
+			"target":      jsonResourceAddr(planItem.Target),
+			"repeat_mode": planItem.RepeatMode,
+			"filename":    planItem.Filename,
+		}
+		if planItem.Provider != "" {
+			fields["provider"] = planItem.Provider
+		}
+		u.emit("planned_config", fmt.Sprintf("Generate a new %s configuration block in %s", planItem.Target, planItem.Filename), fields)
+	}
+	u.emit("plan_summary", fmt.Sprintf("Plan: %d to import, %d to generate.", len(plan.ToState), len(plan.ToConfig)), map[string]interface{}{
+		"import":   len(plan.ToState),
+		"generate": len(plan.ToConfig),
+	})
+}
+
+func (u *jsonUI) PlanSaved(filename string) {
+	u.emit("plan_saved", fmt.Sprintf("Saved the import plan to %s", filename), map[string]interface{}{
+		"filename": filename,
+	})
+}
+
+func (u *jsonUI) Cancelled() {
+	u.emit("cancelled", "Cancelled.", nil)
+}
+
+func (u *jsonUI) ImportStart(plan *importPlan) {
+	u.emit("import_start", "Importing", map[string]interface{}{
+		"import_blocks": plan.ImportBlocksFile != "",
+	})
+}
+
+func (u *jsonUI) Importing(action *importPlanState) {
+	u.emit("import", fmt.Sprintf("Importing %s with id %q", action.Target, action.ID), map[string]interface{}{
+		"target": jsonInstanceAddr(action.Target),
+		"id":     action.ID,
+	})
+}
+
+func (u *jsonUI) FetchingState() {
+	u.emit("fetch_state", "Fetching the latest Terraform state snapshot", nil)
+}
+
+func (u *jsonUI) WritingImportBlocks(filename string, count int) {
+	u.emit("import_blocks", fmt.Sprintf("Adding %d import blocks to %s", count, filename), map[string]interface{}{
+		"filename": filename,
+		"count":    count,
+	})
+}
+
+func (u *jsonUI) GeneratingConfig(action *importPlanConfig) {
+	u.emit("generate_config", fmt.Sprintf("Adding a new %s block to %s", action.Target, action.Filename), map[string]interface{}{
+		"target":   jsonResourceAddr(action.Target),
+		"filename": action.Filename,
+	})
+}
+
+func (u *jsonUI) Minimizing(action *importPlanConfig) {
+	u.emit("minimize_start", fmt.Sprintf("Minimizing the configuration for %s", action.Target), map[string]interface{}{
+		"target": jsonResourceAddr(action.Target),
+	})
+}
+
+func (u *jsonUI) Minimized(action *importPlanConfig, removed []string) {
+	if removed == nil {
+		removed = []string{} // serialize as an empty array, rather than null
+	}
+	u.emit("minimize", fmt.Sprintf("Removed %d unnecessary arguments from %s", len(removed), action.Target), map[string]interface{}{
+		"target":  jsonResourceAddr(action.Target),
+		"removed": removed,
+	})
+}
+
+func (u *jsonUI) ValidatingConfig() {
+	u.emit("validate_config", "Validating the generated configuration", nil)
+}
+
+func (u *jsonUI) Resuming(imported, generated int) {
+	u.emit("resume", fmt.Sprintf("Resuming an unfinished apply, skipping %d imports and %d resources", imported, generated), map[string]interface{}{
+		"imported":  imported,
+		"generated": generated,
+	})
+}
+
+func (u *jsonUI) RollingBack(mode string) {
+	u.emit("rollback_start", "Undoing the changes from this run", map[string]interface{}{
+		"mode": mode,
+	})
+}
+
+func (u *jsonUI) RolledBack(instances []resourceInstanceAddr, files []string) {
+	addrs := make([]interface{}, len(instances))
+	for i, addr := range instances {
+		addrs[i] = jsonInstanceAddr(addr)
+	}
+	if files == nil {
+		files = []string{} // serialize as an empty array, rather than null
+	}
+	u.emit("rollback", fmt.Sprintf("Removed %d instances from the state and restored %d files", len(instances), len(files)), map[string]interface{}{
+		"removed":  addrs,
+		"restored": files,
+	})
+}
+
+func (u *jsonUI) Done(plan *importPlan) {
+	u.emit("done", "All done!", nil)
+}
+
+func (u *jsonUI) emit(typ, msg string, fields map[string]interface{}) {
+	obj := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj["type"] = typ
+	obj["@message"] = msg
+	writeJSONLine(u.w, obj)
+}
+
+func jsonResourceAddr(addr resourceAddr) map[string]interface{} {
+	ret := map[string]interface{}{
+		"addr": addr.String(),
+		"mode": string(addr.Mode),
+		"type": addr.Type,
+		"name": addr.Name,
+	}
+	if addr.Module != "" {
+		ret["module"] = addr.Module
+	}
+	return ret
+}
+
+func jsonInstanceAddr(addr resourceInstanceAddr) map[string]interface{} {
+	ret := jsonResourceAddr(addr.Resource)
+	ret["addr"] = addr.String()
+	if addr.InstanceKey != nil {
+		ret["key"] = addr.InstanceKey
+	}
+	return ret
+}
+
+// WriteDiagnosticsJSON writes the given diagnostics to the given writer as
+// "diagnostic" events in the same format used by the -json output mode.
+func WriteDiagnosticsJSON(w io.Writer, diags hcl.Diagnostics) {
+	for _, diag := range diags {
+		var severity, label string
+		switch diag.Severity {
+		case hcl.DiagError:
+			severity, label = "error", "Error"
+		case hcl.DiagWarning:
+			severity, label = "warning", "Warning"
+		default:
+			severity, label = "unknown", "Diagnostic"
+		}
+
+		jsonDiag := map[string]interface{}{
+			"severity": severity,
+			"summary":  diag.Summary,
+			"detail":   diag.Detail,
+		}
+		if diag.Subject != nil {
+			jsonDiag["range"] = jsonRange(*diag.Subject)
+		}
+		if diag.Context != nil {
+			jsonDiag["context_range"] = jsonRange(*diag.Context)
+		}
+
+		writeJSONLine(w, map[string]interface{}{
+			"type":       "diagnostic",
+			"@message":   fmt.Sprintf("%s: %s", label, diag.Summary),
+			"diagnostic": jsonDiag,
+		})
+	}
+}
+
+func jsonRange(rng hcl.Range) map[string]interface{} {
+	return map[string]interface{}{
+		"filename": rng.Filename,
+		"start":    jsonPos(rng.Start),
+		"end":      jsonPos(rng.End),
+	}
+}
+
+func jsonPos(pos hcl.Pos) map[string]interface{} {
+	return map[string]interface{}{
+		"line":   pos.Line,
+		"column": pos.Column,
+		"byte":   pos.Byte,
+	}
+}
+
+func writeJSONLine(w io.Writer, obj interface{}) {
+	src, err := json.Marshal(obj)
+	if err != nil {
+		// Should never happen, because we only use JSON-friendly types above.
+		panic(fmt.Sprintf("failed to serialize JSON event: %s", err))
+	}
+	src = append(src, '\n')
+	w.Write(src)
+}
@@ -0,0 +1,86 @@
+package terrafy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// validateGeneratedConfig runs "terraform validate" in the main working
+// directory to check that the configuration we generated is valid, returning
+// any problems that Terraform reports as diagnostics.
+//
+// Terrafy's generated configuration is derived mechanically from provider
+// schemas, which aren't always accurate about which arguments can be set,
+// so it's better to find out about problems now than at the next plan.
+func validateGeneratedConfig(opts *Options) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	stdout, err := runTerraform(context.Background(), opts.TerraformExec, opts.dir(), nil, "validate", "-json")
+
+	type jsonPos struct {
+		Line   int `json:"line"`
+		Column int `json:"column"`
+		Byte   int `json:"byte"`
+	}
+	type jsonRange struct {
+		Filename string  `json:"filename"`
+		Start    jsonPos `json:"start"`
+		End      jsonPos `json:"end"`
+	}
+	type jsonResult struct {
+		Valid       bool `json:"valid"`
+		Diagnostics []struct {
+			Severity string     `json:"severity"`
+			Summary  string     `json:"summary"`
+			Detail   string     `json:"detail"`
+			Range    *jsonRange `json:"range"`
+		} `json:"diagnostics"`
+	}
+
+	var result jsonResult
+	if jsonErr := json.Unmarshal(stdout, &result); jsonErr != nil {
+		if err == nil {
+			err = jsonErr
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to validate generated configuration",
+			Detail:   fmt.Sprintf("Could not run \"terraform validate\" to check the generated configuration:\n\n%s", err),
+		})
+		return diags
+	}
+
+	for _, jsonDiag := range result.Diagnostics {
+		diag := &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  jsonDiag.Summary,
+			Detail:   jsonDiag.Detail,
+		}
+		if jsonDiag.Severity == "warning" {
+			diag.Severity = hcl.DiagWarning
+		}
+		if r := jsonDiag.Range; r != nil {
+			diag.Subject = &hcl.Range{
+				// Terraform reports filenames relative to its working
+				// directory, which may not be ours.
+				Filename: filepath.Join(opts.dir(), r.Filename),
+				Start:    hcl.Pos{Line: r.Start.Line, Column: r.Start.Column, Byte: r.Start.Byte},
+				End:      hcl.Pos{Line: r.End.Line, Column: r.End.Column, Byte: r.End.Byte},
+			}
+		}
+		diags = append(diags, diag)
+	}
+
+	if !result.Valid {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Generated configuration is invalid",
+			Detail:   "Terrafy generated the configuration for the imported objects, but Terraform reports that it is invalid. Correct the problems reported above before running \"terraform plan\".\n\nIf Terrafy generated an argument that can't actually be set, you can prevent it from doing so in future by listing it in skip_arguments in the terrafy block.",
+		})
+	}
+	return diags
+}
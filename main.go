@@ -2,16 +2,88 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/apparentlymart/terrafy/internal/terrafy"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform-exec/tfexec"
 	"github.com/hashicorp/terraform-exec/tfinstall"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// version is the version of Terrafy itself, which can be overridden at
+// build time using the linker's -X option.
+var version = "0.0.0-dev"
+
+const usage = `Usage: terrafy [global options] <subcommand> [options] [args]
+
+Terrafy batch-imports existing remote objects into a Terraform state and
+generates configuration for them, as described by the .tfy files in the
+current working directory.
+
+Subcommands:
+  plan        Show which objects would be imported and which configuration
+              blocks would be generated. Use -out=FILE to save the plan so
+              that it can be applied later.
+  apply       Create an import plan and then, after confirmation, carry it
+              out. Use -auto-approve to skip the confirmation prompt, or
+              give the filename of a saved plan to apply it directly.
+              Use -minimize to remove any generated arguments that turn
+              out to be unnecessary, which requires Terraform v0.15.3 or
+              later. Use -rollback=remove or -rollback=restore to undo a
+              partially-completed apply if a later step fails, or
+              -resume to continue an earlier apply that didn't complete.
+  validate    Check whether the Terrafy configuration is valid.
+  version     Show the current Terrafy and Terraform versions.
+
+  The plan, apply, and validate subcommands all accept -json to produce
+  machine-readable output as a stream of JSON objects, one per line.
+
+  The plan and apply subcommands accept -import-blocks to generate import
+  blocks in imports.tf for Terraform v1.5 or later, instead of importing
+  directly into the Terraform state.
+
+  The plan and apply subcommands also accept -var 'NAME=VALUE' and
+  -var-file=FILE, which set values for the variables declared in the .tfy
+  files in the same way as the Terraform options of the same names.
+
+Global options:
+  -chdir=DIR        Switch to a different working directory before running
+                    the given subcommand.
+  -terraform=PATH   Use the Terraform CLI executable at the given path,
+                    rather than searching for "terraform" in PATH.
+  -no-color         Disable terminal formatting sequences in the output.
+`
+
 func main() {
+	os.Exit(realMain(os.Args[1:]))
+}
+
+func realMain(args []string) int {
+	var opts terrafy.Options
+
+	globalFlags := flag.NewFlagSet("terrafy", flag.ContinueOnError)
+	globalFlags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	globalFlags.StringVar(&opts.Dir, "chdir", "", "")
+	globalFlags.StringVar(&opts.TerraformExec, "terraform", "", "")
+	globalFlags.BoolVar(&opts.NoColor, "no-color", false, "")
+	if err := globalFlags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	args = globalFlags.Args()
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 1
+	}
+
 	isTerm := terminal.IsTerminal(int(os.Stderr.Fd()))
 	width := 79
 	if isTerm {
@@ -20,24 +92,125 @@ func main() {
 			width = w
 		}
 	}
+	if opts.NoColor {
+		isTerm = false
+	}
+
+	cmdName, args := args[0], args[1:]
+	var run func(*terrafy.Options) (map[string]*hcl.File, hcl.Diagnostics)
+	cmdFlags := flag.NewFlagSet("terrafy "+cmdName, flag.ContinueOnError)
+	switch cmdName {
+	case "plan":
+		run = terrafy.Plan
+		cmdFlags.StringVar(&opts.PlanOut, "out", "", "")
+		cmdFlags.BoolVar(&opts.JSON, "json", false, "")
+		cmdFlags.BoolVar(&opts.ImportBlocks, "import-blocks", false, "")
+		cmdFlags.Var((*stringsFlag)(&opts.Vars), "var", "")
+		cmdFlags.Var((*stringsFlag)(&opts.VarFiles), "var-file", "")
+	case "apply":
+		run = terrafy.Apply
+		cmdFlags.BoolVar(&opts.AutoApprove, "auto-approve", false, "")
+		cmdFlags.BoolVar(&opts.Minimize, "minimize", false, "")
+		cmdFlags.StringVar(&opts.Rollback, "rollback", "", "")
+		cmdFlags.BoolVar(&opts.Resume, "resume", false, "")
+		cmdFlags.BoolVar(&opts.JSON, "json", false, "")
+		cmdFlags.BoolVar(&opts.ImportBlocks, "import-blocks", false, "")
+		cmdFlags.Var((*stringsFlag)(&opts.Vars), "var", "")
+		cmdFlags.Var((*stringsFlag)(&opts.VarFiles), "var-file", "")
+	case "validate":
+		run = terrafy.Validate
+		cmdFlags.BoolVar(&opts.JSON, "json", false, "")
+	case "version":
+		// Handled separately below, because it has nothing to report
+		// about the configuration.
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unsupported subcommand %q.\n\n%s", cmdName, usage)
+		return 1
+	}
+	if err := cmdFlags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if cmdName == "apply" && cmdFlags.NArg() == 1 {
+		// "terrafy apply FILE" applies a saved plan.
+		opts.PlanFile = cmdFlags.Arg(0)
+	} else if cmdFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: Unexpected arguments for %q: %s.\n\n", cmdName, strings.Join(cmdFlags.Args(), " "))
+		return 1
+	}
 
-	// TODO: Make Terraform executable path customizable with a
-	// command line option.
-	execFile, err := tfinstall.Find(context.Background(), tfinstall.LookPath())
+	// The -terraform option is taken verbatim if given, and otherwise we
+	// search for a "terraform" executable in the PATH.
+	var finder tfinstall.ExecPathFinder = tfinstall.LookPath()
+	if opts.TerraformExec != "" {
+		finder = tfinstall.ExactPath(opts.TerraformExec)
+	}
+	execFile, err := tfinstall.Find(context.Background(), finder)
 	if err != nil {
-		fmt.Fprint(os.Stderr, "Error: Can't find 'terraform' executable in your PATH.\n\n")
-		os.Exit(1)
+		if opts.TerraformExec != "" {
+			fmt.Fprintf(os.Stderr, "Error: Can't use %s as the Terraform executable: %s.\n\n", opts.TerraformExec, err)
+		} else {
+			fmt.Fprint(os.Stderr, "Error: Can't find 'terraform' executable in your PATH.\n\n")
+		}
+		if cmdName != "version" {
+			return 1
+		}
 	}
+	opts.TerraformExec = execFile
 
-	opts := terrafy.Options{
-		TerraformExec: execFile,
+	if cmdName == "version" {
+		return showVersion(&opts)
 	}
-	sourceFiles, diags := terrafy.Run(&opts)
-	if len(diags) != 0 {
+
+	sourceFiles, diags := run(&opts)
+	if opts.JSON {
+		// In JSON mode the diagnostics are just more events in the stream.
+		terrafy.WriteDiagnosticsJSON(os.Stdout, diags)
+	} else if len(diags) != 0 {
 		wr := hcl.NewDiagnosticTextWriter(os.Stderr, sourceFiles, uint(width), isTerm)
 		wr.WriteDiagnostics(diags)
 	}
 	if diags.HasErrors() {
-		os.Exit(1)
+		return 1
+	}
+	return 0
+}
+
+func showVersion(opts *terrafy.Options) int {
+	fmt.Printf("Terrafy v%s\n", version)
+	if opts.TerraformExec == "" {
+		return 0
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		dir = "."
+	}
+	tf, err := tfexec.NewTerraform(dir, opts.TerraformExec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Terraform executable at %s is malfunctioning or not available: %s.\n\n", opts.TerraformExec, err)
+		return 1
+	}
+	tfVersion, _, err := tf.Version(context.Background(), true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to determine the Terraform version: %s.\n\n", err)
+		return 1
 	}
+	fmt.Printf("Terraform v%s at %s\n", tfVersion, opts.TerraformExec)
+	return 0
+}
+
+// stringsFlag is a flag.Value that collects all of the values given for a
+// flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }